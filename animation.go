@@ -0,0 +1,337 @@
+package asset_delivery
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+)
+
+var ErrAnimationTooLarge = errors.New("animation too large")
+
+// ErrAnimatedWebP rejects animated WebP sources. The WebP decoder reads
+// them as a single still, so their animation would be silently dropped.
+var ErrAnimatedWebP = errors.New("animated webp not supported")
+
+// MaxAnimationFrames caps the number of frames in an animated source.
+var MaxAnimationFrames = 500
+
+// MaxAnimationPixels caps the total number of pixels, summed over every
+// frame, of an animation before and after resizing. Frames are held
+// uncompressed while they are resized, so this bounds the worker's memory.
+var MaxAnimationPixels = 50_000_000
+
+// Animation is a decoded multi-frame image. Every frame is composited, so
+// each one is a complete picture of the same size as the first.
+type Animation struct {
+	Frames []image.Image
+	// Delays holds the display time of each frame in 100ths of a second.
+	Delays []int
+	// Palettes holds the source palette of each frame, when it had one,
+	// so that re-encoding to a paletted format keeps the original colours.
+	Palettes  []color.Palette
+	LoopCount int
+}
+
+func checkAnimationBudget(frames, width, height int) error {
+	if frames > MaxAnimationFrames {
+		return fmt.Errorf("%w: %d frames, limit %d", ErrAnimationTooLarge, frames, MaxAnimationFrames)
+	}
+	if pixels := frames * width * height; pixels > MaxAnimationPixels {
+		return fmt.Errorf("%w: %d pixels, limit %d", ErrAnimationTooLarge, pixels, MaxAnimationPixels)
+	}
+	return nil
+}
+
+// ResizeAnimation resizes every frame of a through ResizeImage. A smart
+// crop is chosen once, from the first frame, so the crop does not jump
+// around between frames.
+func ResizeAnimation(a *Animation, opts ResizeOptions) (*Animation, error) {
+	if len(a.Frames) == 0 {
+		return nil, ErrInvalidBounds
+	}
+	if opts.Fit == FitCover && opts.Gravity == GravitySmart && opts.Focus == nil && opts.Width > 0 && opts.Height > 0 {
+		first := a.Frames[0]
+		b := first.Bounds()
+		crop := SmartCrop(first, int(opts.Width), int(opts.Height))
+		c := crop.Min.Add(crop.Max).Div(2).Sub(b.Min)
+		opts.Gravity = ""
+		opts.Focus = &FocalPoint{X: float64(c.X) / float64(b.Dx()), Y: float64(c.Y) / float64(b.Dy())}
+	}
+
+	out := &Animation{
+		Frames:    make([]image.Image, len(a.Frames)),
+		Delays:    a.Delays,
+		Palettes:  a.Palettes,
+		LoopCount: a.LoopCount,
+	}
+	for i, frame := range a.Frames {
+		img, err := ResizeImage(frame, opts)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			b := img.Bounds()
+			if err := checkAnimationBudget(len(a.Frames), b.Dx(), b.Dy()); err != nil {
+				return nil, err
+			}
+		}
+		out.Frames[i] = img
+	}
+	return out, nil
+}
+
+// decodeGIFAnimation decodes every frame of a GIF and composites them,
+// applying each frame's disposal method, into an Animation. The budget is
+// checked from the block structure first, since gif.DecodeAll allocates
+// every frame before returning.
+func decodeGIFAnimation(r io.Reader) (*Animation, error) {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	frames, area := scanGIF(buf)
+	if err := checkAnimationBudget(frames, area.Dx(), area.Dy()); err != nil {
+		return nil, err
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Image) == 0 {
+		return nil, ErrInvalidBounds
+	}
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		for _, frame := range g.Image {
+			bounds = bounds.Union(frame.Bounds())
+		}
+	}
+	if err := checkAnimationBudget(len(g.Image), bounds.Dx(), bounds.Dy()); err != nil {
+		return nil, err
+	}
+
+	a := &Animation{
+		Frames:    make([]image.Image, len(g.Image)),
+		Delays:    make([]int, len(g.Image)),
+		Palettes:  make([]color.Palette, len(g.Image)),
+		LoopCount: g.LoopCount,
+	}
+	canvas := image.NewNRGBA(bounds)
+	for i, frame := range g.Image {
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			previous = cloneNRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		a.Frames[i] = cloneNRGBA(canvas)
+		// A frame's local palette only covers the pixels it draws; the
+		// composited frame also shows earlier frames, so keep their
+		// colours where there is room.
+		a.Palettes[i] = frame.Palette
+		if i > 0 {
+			a.Palettes[i] = mergePalettes(frame.Palette, a.Palettes[i-1])
+		}
+		if i < len(g.Delay) {
+			a.Delays[i] = g.Delay[i]
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return a, nil
+}
+
+// scanGIF walks the blocks of a GIF without decompressing any frame. It
+// returns the number of frames, counting no further than one past
+// MaxAnimationFrames, and the canvas they are composited onto: the logical
+// screen or, when that is empty, the union of the frames. Malformed files
+// are left for the decoder to reject.
+func scanGIF(b []byte) (int, image.Rectangle) {
+	const (
+		headerLen     = 6
+		screenLen     = 7
+		descriptorLen = 9
+	)
+	if len(b) < headerLen+screenLen {
+		return 0, image.Rectangle{}
+	}
+	screen := image.Rect(0, 0, int(binary.LittleEndian.Uint16(b[6:])), int(binary.LittleEndian.Uint16(b[8:])))
+	var union image.Rectangle
+	pos := headerLen + screenLen
+	if flags := b[10]; flags&0x80 != 0 {
+		pos += 3 << ((flags & 0x07) + 1)
+	}
+	// skipSubBlocks returns the position after the terminator of the data
+	// sub-blocks starting at p, or -1 if they run past the end.
+	skipSubBlocks := func(p int) int {
+		for p < len(b) {
+			n := int(b[p])
+			p++
+			if n == 0 {
+				return p
+			}
+			p += n
+		}
+		return -1
+	}
+
+	frames := 0
+	for pos >= 0 && pos < len(b) && frames <= MaxAnimationFrames {
+		switch b[pos] {
+		case 0x21: // Extension: label, then sub-blocks.
+			pos = skipSubBlocks(pos + 2)
+		case 0x2C: // Image descriptor, local colour table, LZW code size, data.
+			if pos+1+descriptorLen > len(b) {
+				pos = -1
+				break
+			}
+			d := b[pos+1:]
+			x, y := int(binary.LittleEndian.Uint16(d[0:])), int(binary.LittleEndian.Uint16(d[2:]))
+			w, h := int(binary.LittleEndian.Uint16(d[4:])), int(binary.LittleEndian.Uint16(d[6:]))
+			union = union.Union(image.Rect(x, y, x+w, y+h))
+			frames++
+			pos += 1 + descriptorLen
+			if flags := d[8]; flags&0x80 != 0 {
+				pos += 3 << ((flags & 0x07) + 1)
+			}
+			pos = skipSubBlocks(pos + 1)
+		default: // Trailer, or not a GIF block.
+			pos = -1
+		}
+	}
+	if screen.Empty() {
+		return frames, union
+	}
+	return frames, screen
+}
+
+// encodeGIFAnimation quantizes every frame of a to its source palette and
+// writes an animated GIF. Frames are complete pictures, so each one
+// replaces the last rather than being drawn over it.
+func encodeGIFAnimation(w io.Writer, a *Animation, opts EncodeOptions) error {
+	if len(a.Frames) == 0 {
+		return ErrInvalidBounds
+	}
+	b := a.Frames[0].Bounds()
+	g := &gif.GIF{
+		Image:     make([]*image.Paletted, len(a.Frames)),
+		Delay:     make([]int, len(a.Frames)),
+		Disposal:  make([]byte, len(a.Frames)),
+		LoopCount: a.LoopCount,
+		Config:    image.Config{Width: b.Dx(), Height: b.Dy()},
+	}
+	for i, frame := range a.Frames {
+		var p color.Palette
+		if i < len(a.Palettes) {
+			p = a.Palettes[i]
+		}
+		if len(p) == 0 {
+			p = paletteWebSafeTransparent
+		}
+		transparent := !isOpaque(frame)
+		if transparent {
+			p = withTransparency(p)
+		}
+
+		fb := frame.Bounds()
+		dst := image.NewPaletted(image.Rect(0, 0, fb.Dx(), fb.Dy()), p)
+		// Nearest-colour matching rather than dithering: independent
+		// dither patterns shimmer from one frame to the next.
+		draw.Draw(dst, dst.Bounds(), frame, fb.Min, draw.Src)
+		g.Image[i] = dst
+		if i < len(a.Delays) {
+			g.Delay[i] = a.Delays[i]
+		}
+		g.Disposal[i] = gif.DisposalNone
+		if transparent {
+			g.Disposal[i] = gif.DisposalBackground
+		}
+	}
+	return gif.EncodeAll(w, g)
+}
+
+// paletteWebSafeTransparent is used for frames that came from a format
+// without palettes.
+var paletteWebSafeTransparent = append(color.Palette{color.Transparent}, palette.WebSafe...)
+
+// mergePalettes returns p followed by the colours of extra that p lacks,
+// up to 256 entries.
+func mergePalettes(p, extra color.Palette) color.Palette {
+	if len(p) >= 256 {
+		return p
+	}
+	seen := make(map[color.RGBA]bool, len(p))
+	for _, c := range p {
+		seen[color.RGBAModel.Convert(c).(color.RGBA)] = true
+	}
+	out := append(color.Palette(nil), p...)
+	for _, c := range extra {
+		if len(out) >= 256 {
+			break
+		}
+		if k := color.RGBAModel.Convert(c).(color.RGBA); !seen[k] {
+			seen[k] = true
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// withTransparency returns p with a fully transparent entry, replacing the
+// last colour when p is already full.
+func withTransparency(p color.Palette) color.Palette {
+	for _, c := range p {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return p
+		}
+	}
+	out := make(color.Palette, len(p), len(p)+1)
+	copy(out, p)
+	if len(out) >= 256 {
+		out[len(out)-1] = color.Transparent
+		return out
+	}
+	return append(out, color.Transparent)
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+func cloneNRGBA(img *image.NRGBA) *image.NRGBA {
+	out := &image.NRGBA{
+		Pix:    make([]uint8, len(img.Pix)),
+		Stride: img.Stride,
+		Rect:   img.Rect,
+	}
+	copy(out.Pix, img.Pix)
+	return out
+}
+
+// isAnimatedWebP reports whether b is an extended WebP file whose VP8X
+// header sets the animation flag.
+func isAnimatedWebP(b []byte) bool {
+	if len(b) < 21 || string(b[0:4]) != "RIFF" || string(b[8:12]) != "WEBP" || string(b[12:16]) != "VP8X" {
+		return false
+	}
+	return b[20]&0x02 != 0
+}
@@ -0,0 +1,253 @@
+package asset_delivery
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"runtime"
+	"testing"
+
+	"github.com/chai2010/webp"
+)
+
+var testGIFPalette = color.Palette{color.Transparent, color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}}
+
+// testGIF returns a 3-frame 40x20 animation: a red background, then a blue
+// square in the top left that is cleared again, then nothing drawn.
+func testGIF(t *testing.T) []byte {
+	t.Helper()
+	bg := image.NewPaletted(image.Rect(0, 0, 40, 20), testGIFPalette)
+	for i := range bg.Pix {
+		bg.Pix[i] = 1
+	}
+	square := image.NewPaletted(image.Rect(0, 0, 10, 10), testGIFPalette)
+	for i := range square.Pix {
+		square.Pix[i] = 2
+	}
+	empty := image.NewPaletted(image.Rect(30, 10, 31, 11), testGIFPalette)
+	empty.Pix[0] = 1
+
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, &gif.GIF{
+		Image:    []*image.Paletted{bg, square, empty},
+		Delay:    []int{10, 20, 30},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalPrevious, gif.DisposalNone},
+		Config:   image.Config{ColorModel: testGIFPalette, Width: 40, Height: 20},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeGIFAnimation(t *testing.T) {
+	a, err := decodeGIFAnimation(bytes.NewReader(testGIF(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Frames) != 3 {
+		t.Fatalf("expected 3 frames, got %d", len(a.Frames))
+	}
+	if a.Delays[1] != 20 {
+		t.Fatalf("expected the delays to be kept, got %v", a.Delays)
+	}
+	blue := color.NRGBA{B: 255, A: 255}
+	red := color.NRGBA{R: 255, A: 255}
+	if got := a.Frames[1].At(5, 5); got != blue {
+		t.Fatalf("expected the second frame to be drawn over the first, got %v", got)
+	}
+	if got := a.Frames[2].At(5, 5); got != red {
+		t.Fatalf("expected the second frame to be disposed to the previous, got %v", got)
+	}
+	for _, f := range a.Frames {
+		if f.Bounds() != image.Rect(0, 0, 40, 20) {
+			t.Fatalf("expected composited frames, got bounds %v", f.Bounds())
+		}
+	}
+}
+
+func TestScanGIF(t *testing.T) {
+	frames, canvas := scanGIF(testGIF(t))
+	if frames != 3 || canvas != image.Rect(0, 0, 40, 20) {
+		t.Fatalf("expected 3 frames on 40x20, got %d on %v", frames, canvas)
+	}
+}
+
+// repeatedGIF returns a GIF of n copies of one blank width x height frame.
+// The frames compress to almost nothing, so the file stays small however
+// much decoding it would allocate.
+func repeatedGIF(t *testing.T, width, height, n int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	frame := image.NewPaletted(image.Rect(0, 0, width, height), testGIFPalette)
+	if err := gif.Encode(&buf, frame, nil); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	header := 13
+	if flags := b[10]; flags&0x80 != 0 {
+		header += 3 << ((flags & 0x07) + 1)
+	}
+	// Everything between the header and the trailer is the frame.
+	block := b[header : len(b)-1]
+	out := append([]byte(nil), b[:header]...)
+	for i := 0; i < n; i++ {
+		out = append(out, block...)
+	}
+	return append(out, 0x3B)
+}
+
+func TestDecodeGIFAnimation_RejectsBombBeforeDecoding(t *testing.T) {
+	src := repeatedGIF(t, 1000, 1000, 200)
+	if len(src) > 1<<20 {
+		t.Fatalf("expected a small source, got %d bytes", len(src))
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	_, err := decodeGIFAnimation(bytes.NewReader(src))
+	runtime.ReadMemStats(&after)
+
+	if !errors.Is(err, ErrAnimationTooLarge) {
+		t.Fatalf("expected ErrAnimationTooLarge, got %v", err)
+	}
+	// Decoding the frames would allocate 200MB.
+	if n := after.TotalAlloc - before.TotalAlloc; n > 10<<20 {
+		t.Fatalf("expected the GIF to be rejected before its frames were decoded, allocated %d bytes", n)
+	}
+}
+
+func TestResizeBytes_AnimatedGIF(t *testing.T) {
+	bits, err := resizeBytes(testGIF(t), ResizeOptions{Width: 20, Location: "https://a/b.gif"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := gif.DecodeAll(bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) != 3 {
+		t.Fatalf("expected 3 frames, got %d", len(g.Image))
+	}
+	if g.Config.Width != 20 || g.Config.Height != 10 {
+		t.Fatalf("expected 20x10, got %dx%d", g.Config.Width, g.Config.Height)
+	}
+	if g.Delay[2] != 30 {
+		t.Fatalf("expected the delays to be kept, got %v", g.Delay)
+	}
+	r, _, _, _ := g.Image[0].At(10, 5).RGBA()
+	if r>>8 != 255 {
+		t.Fatalf("expected the source palette to be kept, got %v", g.Image[0].At(10, 5))
+	}
+}
+
+func TestResizeBytes_AnimatedGIFToWebPKeepsFirstFrame(t *testing.T) {
+	bits, err := resizeBytes(testGIF(t), ResizeOptions{Width: 20, Location: "https://a/b.gif", Encoding: "webp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := webp.Decode(bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 10 {
+		t.Fatalf("expected 20x10, got %v", b)
+	}
+}
+
+func TestResizeBytes_AnimationBudget(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Frames int
+		Pixels int
+		Opts   ResizeOptions
+	}{
+		{"too many frames", 2, MaxAnimationPixels, ResizeOptions{Width: 20}},
+		{"too many source pixels", MaxAnimationFrames, 40 * 20 * 2, ResizeOptions{Width: 20}},
+		{"too many output pixels", MaxAnimationFrames, 4096 * 2048 * 2, ResizeOptions{Width: 4096}},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			frames, pixels := MaxAnimationFrames, MaxAnimationPixels
+			MaxAnimationFrames, MaxAnimationPixels = c.Frames, c.Pixels
+			defer func() { MaxAnimationFrames, MaxAnimationPixels = frames, pixels }()
+
+			c.Opts.Location = "https://a/b.gif"
+			_, err := resizeBytes(testGIF(t), c.Opts)
+			var perr *ParamError
+			if !errors.As(err, &perr) || !errors.Is(perr.Root(), ErrAnimationTooLarge) {
+				t.Fatalf("expected a ParamError for the animation budget, got %v", err)
+			}
+		})
+	}
+}
+
+// testAnimatedWebP returns a 2-frame 4x4 animated WebP, each frame a
+// lossless bitstream wrapped in an ANMF chunk.
+func testAnimatedWebP(t *testing.T) []byte {
+	t.Helper()
+	chunk := func(fourcc string, payload []byte) []byte {
+		b := append([]byte(fourcc), le(uint32(len(payload)), 4)...)
+		b = append(b, payload...)
+		if len(payload)%2 == 1 {
+			b = append(b, 0)
+		}
+		return b
+	}
+	body := []byte("WEBP")
+	body = append(body, chunk("VP8X", append([]byte{0x02, 0, 0, 0}, append(le(3, 3), le(3, 3)...)...))...)
+	body = append(body, chunk("ANIM", []byte{0, 0, 0, 0, 0, 0})...)
+	for _, c := range []color.NRGBA{{R: 255, A: 255}, {B: 255, A: 255}} {
+		img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+		for i := 0; i < len(img.Pix); i += 4 {
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+		}
+		var buf bytes.Buffer
+		if err := webp.Encode(&buf, img, &webp.Options{Lossless: true}); err != nil {
+			t.Fatal(err)
+		}
+		// Skip the RIFF header to the still's bitstream chunk.
+		frame := append(le(0, 3), le(0, 3)...)
+		frame = append(frame, le(3, 3)...)
+		frame = append(frame, le(3, 3)...)
+		frame = append(frame, le(100, 3)...)
+		frame = append(frame, 0)
+		body = append(body, chunk("ANMF", append(frame, buf.Bytes()[12:]...))...)
+	}
+	return append(append([]byte("RIFF"), le(uint32(len(body)), 4)...), body...)
+}
+
+// le encodes v in n little-endian bytes.
+func le(v uint32, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(v >> (8 * i))
+	}
+	return b
+}
+
+func TestResizeBytes_RejectsAnimatedWebP(t *testing.T) {
+	src := testAnimatedWebP(t)
+	if !isAnimatedWebP(src) {
+		t.Fatal("expected the fixture to be detected as animated")
+	}
+	_, err := resizeBytes(src, ResizeOptions{Width: 2, Encoding: "webp"})
+	var perr *ParamError
+	if !errors.As(err, &perr) || !errors.Is(perr.RootError, ErrAnimatedWebP) {
+		t.Fatalf("expected a ParamError for the animated WebP, got %v", err)
+	}
+
+	var still bytes.Buffer
+	if err := webp.Encode(&still, image.NewNRGBA(image.Rect(0, 0, 4, 4)), &webp.Options{Lossless: true}); err != nil {
+		t.Fatal(err)
+	}
+	if isAnimatedWebP(still.Bytes()) {
+		t.Fatal("expected a still WebP not to be detected as animated")
+	}
+	if _, err := resizeBytes(still.Bytes(), ResizeOptions{Width: 2, Encoding: "webp"}); err != nil {
+		t.Fatalf("expected a still WebP to resize, got %v", err)
+	}
+}
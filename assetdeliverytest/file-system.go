@@ -0,0 +1,307 @@
+// Package assetdeliverytest provides in-memory FileSystem and Messager
+// implementations for testing code built on asset-delivery.
+package assetdeliverytest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	assetdelivery "github.com/monstercat/asset-delivery"
+)
+
+var (
+	_ assetdelivery.FileSystem     = (*FileSystem)(nil)
+	_ assetdelivery.FileInfoObject = (*File)(nil)
+	_ assetdelivery.Leaser         = (*FileSystem)(nil)
+)
+
+// Op names a FileSystem method for error injection.
+type Op string
+
+const (
+	OpInfo       Op = "Info"
+	OpReadCloser Op = "ReadCloser"
+	OpWrite      Op = "Write"
+	OpDelete     Op = "Delete"
+	OpLease      Op = "Lease"
+)
+
+// File is an object stored in a FileSystem.
+type File struct {
+	Data      []byte
+	Control   string
+	CreatedAt time.Time
+	Type      string
+}
+
+func (f *File) CacheControl() string {
+	return f.Control
+}
+
+func (f *File) Created() time.Time {
+	return f.CreatedAt
+}
+
+func (f *File) ContentType() string {
+	return f.Type
+}
+
+func (f *File) Size() int64 {
+	return int64(len(f.Data))
+}
+
+// ETag is the MD5 of the data, as S3 reports for simple uploads.
+func (f *File) ETag() string {
+	return fmt.Sprintf(`"%x"`, md5.Sum(f.Data))
+}
+
+type fsState struct {
+	mu     sync.Mutex
+	files  map[string]*File
+	errs   map[string]error
+	leases map[string]time.Time
+}
+
+// FileSystem is a concurrency-safe in-memory assetdelivery.FileSystem.
+// Volumes returned by FromVolume share storage with their parent but keep
+// their objects separate.
+type FileSystem struct {
+	// Host prefixes the URLs returned by ObjectURL.
+	Host string
+
+	// Now stamps the Created time of written objects. Defaults to
+	// time.Now; override it to control expiry.
+	Now func() time.Time
+
+	volume string
+	state  *fsState
+}
+
+func NewFileSystem() *FileSystem {
+	return &FileSystem{
+		Host: "https://storage.test",
+		state: &fsState{
+			files:  make(map[string]*File),
+			errs:   make(map[string]error),
+			leases: make(map[string]time.Time),
+		},
+	}
+}
+
+func (fs *FileSystem) key(filename string) string {
+	return fs.volume + "\x00" + filename
+}
+
+func errKey(op Op, volume, filename string) string {
+	return string(op) + "\x00" + volume + "\x00" + filename
+}
+
+// FailOn makes op return err for filename in this volume. An empty filename
+// fails op for every object. A nil err clears a previous failure.
+func (fs *FileSystem) FailOn(op Op, filename string, err error) {
+	fs.state.mu.Lock()
+	defer fs.state.mu.Unlock()
+	k := errKey(op, fs.volume, filename)
+	if err == nil {
+		delete(fs.state.errs, k)
+		return
+	}
+	fs.state.errs[k] = err
+}
+
+// injected must be called with the lock held.
+func (fs *FileSystem) injected(op Op, filename string) error {
+	if err, ok := fs.state.errs[errKey(op, fs.volume, filename)]; ok {
+		return err
+	}
+	return fs.state.errs[errKey(op, fs.volume, "")]
+}
+
+// Put stores an object directly, bypassing injected errors.
+func (fs *FileSystem) Put(filename string, data []byte, cacheControl string, created time.Time) {
+	fs.state.mu.Lock()
+	defer fs.state.mu.Unlock()
+	fs.state.files[fs.key(filename)] = &File{
+		Data:      append([]byte(nil), data...),
+		Control:   cacheControl,
+		CreatedAt: created,
+	}
+}
+
+// Get returns a copy of the stored object.
+func (fs *FileSystem) Get(filename string) (File, bool) {
+	fs.state.mu.Lock()
+	defer fs.state.mu.Unlock()
+	f, ok := fs.state.files[fs.key(filename)]
+	if !ok {
+		return File{}, false
+	}
+	c := *f
+	c.Data = append([]byte(nil), f.Data...)
+	return c, true
+}
+
+// SetContentType changes the Content-Type of a stored object. It reports
+// whether the object exists.
+func (fs *FileSystem) SetContentType(filename, contentType string) bool {
+	fs.state.mu.Lock()
+	defer fs.state.mu.Unlock()
+	f, ok := fs.state.files[fs.key(filename)]
+	if ok {
+		f.Type = contentType
+	}
+	return ok
+}
+
+// SetCreated changes the Created time of a stored object. It reports
+// whether the object exists.
+func (fs *FileSystem) SetCreated(filename string, t time.Time) bool {
+	fs.state.mu.Lock()
+	defer fs.state.mu.Unlock()
+	f, ok := fs.state.files[fs.key(filename)]
+	if ok {
+		f.CreatedAt = t
+	}
+	return ok
+}
+
+// Names lists the objects in this volume in sorted order.
+func (fs *FileSystem) Names() []string {
+	fs.state.mu.Lock()
+	defer fs.state.mu.Unlock()
+	prefix := fs.volume + "\x00"
+	var names []string
+	for k := range fs.state.files {
+		if strings.HasPrefix(k, prefix) {
+			names = append(names, strings.TrimPrefix(k, prefix))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (fs *FileSystem) FromVolume(name string) assetdelivery.FileSystem {
+	return &FileSystem{
+		Host:   fs.Host,
+		Now:    fs.Now,
+		volume: name,
+		state:  fs.state,
+	}
+}
+
+func (fs *FileSystem) ObjectURL(filename string) string {
+	return fs.Host + path.Join("/", fs.volume, filename)
+}
+
+func (fs *FileSystem) Info(filename string) (assetdelivery.FileInfo, error) {
+	fs.state.mu.Lock()
+	defer fs.state.mu.Unlock()
+	if err := fs.injected(OpInfo, filename); err != nil {
+		return nil, err
+	}
+	f, ok := fs.state.files[fs.key(filename)]
+	if !ok {
+		return nil, assetdelivery.ErrNoFile
+	}
+	return &File{Data: f.Data, Control: f.Control, CreatedAt: f.CreatedAt, Type: f.Type}, nil
+}
+
+func (fs *FileSystem) ReadCloser(filename string) (io.ReadCloser, error) {
+	fs.state.mu.Lock()
+	defer fs.state.mu.Unlock()
+	if err := fs.injected(OpReadCloser, filename); err != nil {
+		return nil, err
+	}
+	f, ok := fs.state.files[fs.key(filename)]
+	if !ok {
+		return nil, assetdelivery.ErrNoFile
+	}
+	return io.NopCloser(bytes.NewReader(f.Data)), nil
+}
+
+func (fs *FileSystem) Write(filename string, r io.Reader, info assetdelivery.FileInfoWrite) error {
+	fs.state.mu.Lock()
+	err := fs.injected(OpWrite, filename)
+	fs.state.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	now := time.Now
+	if fs.Now != nil {
+		now = fs.Now
+	}
+
+	fs.state.mu.Lock()
+	defer fs.state.mu.Unlock()
+	fs.state.files[fs.key(filename)] = &File{
+		Data:      data,
+		Control:   info.CacheControl(),
+		CreatedAt: now(),
+	}
+	if v, ok := info.(assetdelivery.FileInfoContentType); ok {
+		fs.state.files[fs.key(filename)].Type = v.ContentType()
+	}
+	return nil
+}
+
+func (fs *FileSystem) Delete(filename string) error {
+	fs.state.mu.Lock()
+	defer fs.state.mu.Unlock()
+	if err := fs.injected(OpDelete, filename); err != nil {
+		return err
+	}
+	k := fs.key(filename)
+	if _, ok := fs.state.files[k]; !ok {
+		return assetdelivery.ErrNoFile
+	}
+	delete(fs.state.files, k)
+	return nil
+}
+
+// Lease implements assetdelivery.Leaser. Leases expire by Now.
+func (fs *FileSystem) Lease(key string, ttl time.Duration) (func() error, error) {
+	fs.state.mu.Lock()
+	defer fs.state.mu.Unlock()
+	if err := fs.injected(OpLease, key); err != nil {
+		return nil, err
+	}
+	now := time.Now
+	if fs.Now != nil {
+		now = fs.Now
+	}
+	k := fs.key(key)
+	if t, ok := fs.state.leases[k]; ok && now().Sub(t) < ttl {
+		return nil, assetdelivery.ErrLeaseHeld
+	}
+	t := now()
+	fs.state.leases[k] = t
+	return func() error {
+		fs.state.mu.Lock()
+		defer fs.state.mu.Unlock()
+		if fs.state.leases[k] != t {
+			return assetdelivery.ErrNoFile
+		}
+		delete(fs.state.leases, k)
+		return nil
+	}, nil
+}
+
+// Leased reports whether key has a lease that has not been released.
+func (fs *FileSystem) Leased(key string) bool {
+	fs.state.mu.Lock()
+	defer fs.state.mu.Unlock()
+	_, ok := fs.state.leases[fs.key(key)]
+	return ok
+}
@@ -0,0 +1,116 @@
+package assetdeliverytest
+
+import (
+	"sync"
+
+	assetdelivery "github.com/monstercat/asset-delivery"
+)
+
+var _ assetdelivery.Messager = (*Messager)(nil)
+
+// Message is a single recorded Publish call.
+type Message struct {
+	Subject string
+	Data    []byte
+}
+
+type subscription struct {
+	m    *Messager
+	subj string
+	h    func([]byte)
+}
+
+func (s *subscription) Unsubscribe() {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	subs := s.m.subs[s.subj]
+	for i, x := range subs {
+		if x == s {
+			s.m.subs[s.subj] = append(subs[:i:i], subs[i+1:]...)
+			return
+		}
+	}
+}
+
+// Messager records every published message and delivers it synchronously
+// to the handlers subscribed to its subject. It is safe for concurrent use.
+type Messager struct {
+	mu        sync.Mutex
+	published []Message
+	subs      map[string][]*subscription
+	err       error
+}
+
+func NewMessager() *Messager {
+	return &Messager{
+		subs: make(map[string][]*subscription),
+	}
+}
+
+// FailPublish makes Publish return err without recording the message. A
+// nil err restores normal behaviour.
+func (m *Messager) FailPublish(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.err = err
+}
+
+// Published returns the recorded messages in publish order.
+func (m *Messager) Published() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.published...)
+}
+
+// PublishedOn returns the recorded messages for subj in publish order.
+func (m *Messager) PublishedOn(subj string) []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var xs []Message
+	for _, x := range m.published {
+		if x.Subject == subj {
+			xs = append(xs, x)
+		}
+	}
+	return xs
+}
+
+// Reset forgets all recorded messages.
+func (m *Messager) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.published = nil
+}
+
+func (m *Messager) Publish(subj string, data []byte) error {
+	m.mu.Lock()
+	if m.err != nil {
+		err := m.err
+		m.mu.Unlock()
+		return err
+	}
+	data = append([]byte(nil), data...)
+	m.published = append(m.published, Message{Subject: subj, Data: data})
+	subs := append([]*subscription(nil), m.subs[subj]...)
+	m.mu.Unlock()
+
+	for _, s := range subs {
+		s.h(data)
+	}
+	return nil
+}
+
+func (m *Messager) Subscribe(subj string, h func([]byte)) (assetdelivery.Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := &subscription{m: m, subj: subj, h: h}
+	m.subs[subj] = append(m.subs[subj], s)
+	return s, nil
+}
+
+// Close drops all subscriptions. Recorded messages remain available.
+func (m *Messager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.subs = make(map[string][]*subscription)
+}
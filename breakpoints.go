@@ -0,0 +1,91 @@
+package asset_delivery
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// BreakpointPolicy decides what happens to widths that are not
+// breakpoints.
+type BreakpointPolicy string
+
+const (
+	// BreakpointSnapUp rounds widths up to the next breakpoint, or down
+	// to the largest one.
+	BreakpointSnapUp BreakpointPolicy = "snap-up"
+	// BreakpointStrict rejects widths that are not breakpoints.
+	BreakpointStrict BreakpointPolicy = "strict"
+)
+
+// Breakpoints limits requested widths to a fixed set so that responsive
+// clients share variants instead of creating one per pixel width.
+type Breakpoints struct {
+	// Widths is sorted ascending.
+	Widths []uint
+	Policy BreakpointPolicy
+}
+
+// ParseBreakpoints parses a comma separated width list, such as
+// "64,128,256", and a policy. An empty list returns nil, meaning any
+// width is accepted.
+func ParseBreakpoints(widths, policy string) (*Breakpoints, error) {
+	b := &Breakpoints{Policy: BreakpointPolicy(policy)}
+	if b.Policy == "" {
+		b.Policy = BreakpointSnapUp
+	}
+	if b.Policy != BreakpointSnapUp && b.Policy != BreakpointStrict {
+		return nil, fmt.Errorf("unknown breakpoint policy %q", policy)
+	}
+	for _, str := range strings.Split(widths, ",") {
+		str = strings.TrimSpace(str)
+		if str == "" {
+			continue
+		}
+		w, err := parseUint(str)
+		if err != nil || w == 0 || w > MaxImageDimension {
+			return nil, fmt.Errorf("invalid breakpoint %q", str)
+		}
+		b.Widths = append(b.Widths, w)
+	}
+	if len(b.Widths) == 0 {
+		return nil, nil
+	}
+	slices.Sort(b.Widths)
+	b.Widths = slices.Compact(b.Widths)
+	return b, nil
+}
+
+// Apply snaps opts.Width to a breakpoint, or rejects it under the strict
+// policy. A requested height is scaled by the same factor so the box keeps
+// its aspect ratio. Requests without a width are left alone.
+func (b *Breakpoints) Apply(opts *ResizeOptions) error {
+	if b == nil || len(b.Widths) == 0 || opts.Width == 0 {
+		return nil
+	}
+	i, found := slices.BinarySearch(b.Widths, opts.Width)
+	if found {
+		return nil
+	}
+	if b.Policy == BreakpointStrict {
+		return &ParamError{Param: "width", Detail: "Expected one of " + b.String() + "."}
+	}
+	width := b.Widths[min(i, len(b.Widths)-1)]
+	if opts.Height > 0 {
+		h := math.Round(float64(opts.Height) * float64(width) / float64(opts.Width))
+		opts.Height = uint(max(1, min(h, MaxImageDimension)))
+	}
+	opts.Width = width
+	return nil
+}
+
+// String lists the widths, comma separated.
+func (b *Breakpoints) String() string {
+	strs := make([]string, len(b.Widths))
+	for i, w := range b.Widths {
+		strs[i] = strconv.FormatUint(uint64(w), 10)
+	}
+	return strings.Join(strs, ", ")
+}
@@ -0,0 +1,61 @@
+package asset_delivery
+
+import "testing"
+
+func TestBreakpoints_Apply(t *testing.T) {
+	snap, err := ParseBreakpoints("256, 64,128,128,2048", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	strict, err := ParseBreakpoints("64,128,256,2048", "strict")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		Name          string
+		Breakpoints   *Breakpoints
+		Width, Height uint
+		WantW, WantH  uint
+		Err           bool
+	}{
+		{"exact", snap, 128, 0, 128, 0, false},
+		{"snaps up", snap, 100, 0, 128, 0, false},
+		{"below the smallest", snap, 1, 0, 64, 0, false},
+		{"above the largest", snap, 4000, 0, 2048, 0, false},
+		{"height keeps the aspect ratio", snap, 100, 50, 128, 64, false},
+		{"height only is left alone", snap, 0, 50, 0, 50, false},
+		{"strict exact", strict, 256, 100, 256, 100, false},
+		{"strict rejects", strict, 100, 0, 100, 0, true},
+		{"none", nil, 100, 0, 100, 0, false},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			opts := ResizeOptions{Width: c.Width, Height: c.Height}
+			err := c.Breakpoints.Apply(&opts)
+			if c.Err {
+				if perr, ok := err.(*ParamError); !ok || perr.Param != "width" {
+					t.Fatalf("expected a ParamError for width, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.Width != c.WantW || opts.Height != c.WantH {
+				t.Fatalf("expected %dx%d, got %dx%d", c.WantW, c.WantH, opts.Width, opts.Height)
+			}
+		})
+	}
+}
+
+func TestParseBreakpoints(t *testing.T) {
+	if b, err := ParseBreakpoints(" , ", "strict"); b != nil || err != nil {
+		t.Fatalf("expected no breakpoints, got %v, %v", b, err)
+	}
+	for _, c := range [][2]string{{"64,abc", ""}, {"0", ""}, {"5000", ""}, {"64", "round"}} {
+		if _, err := ParseBreakpoints(c[0], c[1]); err == nil {
+			t.Errorf("expected an error for %q, %q", c[0], c[1])
+		}
+	}
+}
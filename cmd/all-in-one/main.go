@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/monstercat/golib/logger"
+	"google.golang.org/api/option"
+
+	. "github.com/monstercat/asset-delivery"
+	"github.com/monstercat/asset-delivery/delivery"
+	"github.com/monstercat/asset-delivery/worker"
+)
+
+// all-in-one serves delivery requests and resizes in background goroutines
+// of the same process, for small deployments and local development.
+func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run returns instead of exiting, so the deferred closes run and the
+// messager finishes the resizes in flight.
+func run() error {
+	var address, credsFilename, allowedHosts, projectId, storage, signingKeys, presetsFile, breakpoints, breakpointPolicy, serve, adminToken string
+	var workers, queueSize, syncConcurrency int
+	var allowPrivate, presetsOnly bool
+	var syncTimeout, pendingTTL, revalidate, leaseTTL, failureTTL time.Duration
+	flag.StringVar(&address, "address", "0.0.0.0:8080", "The binding address for the application.")
+	flag.StringVar(&credsFilename, "credentials", "", "Path to a Google JWT credentials file. Empty uses ADC.")
+	flag.StringVar(&allowedHosts, "allow", "", "A comma separated list of domain hosts. An empty value permits none.")
+	flag.BoolVar(&allowPrivate, "allow-private", false, "Allow fetching sources from private, loopback and link-local addresses.")
+	flag.StringVar(&projectId, "project-id", "", "GCP project ID. When set, logs go to Cloud Logging instead of stdout.")
+	flag.StringVar(&storage, "storage", os.Getenv("STORAGE"), "File system backend: gcloud (default), s3 or local.")
+	flag.StringVar(&presetsFile, "presets", os.Getenv("PRESETS"), "Path to a JSON file of named presets.")
+	flag.BoolVar(&presetsOnly, "presets-only", false, "Only accept variants chosen with a preset.")
+	flag.StringVar(&breakpoints, "breakpoints", os.Getenv("BREAKPOINTS"), "Comma separated widths requests are snapped to, e.g. 64,128,256. Empty accepts any width.")
+	flag.StringVar(&breakpointPolicy, "breakpoint-policy", os.Getenv("BREAKPOINT_POLICY"), "snap-up (default) rounds widths up to a breakpoint; strict rejects other widths.")
+	flag.DurationVar(&syncTimeout, "sync-timeout", delivery.DefaultSyncTimeout, "How long sync requests wait for an inline resize.")
+	flag.IntVar(&syncConcurrency, "sync-concurrency", delivery.DefaultSyncConcurrency, "How many inline resizes for sync requests may run at once.")
+	flag.DurationVar(&pendingTTL, "pending-ttl", delivery.DefaultPendingTTL, "How long a published resize request is not published again.")
+	flag.DurationVar(&revalidate, "revalidate", 0, "How often served variants are checked for a changed source at the origin. 0 disables it.")
+	flag.StringVar(&serve, "serve", os.Getenv("SERVE"), "redirect (default) redirects to stored objects; proxy streams them.")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("ADMIN_TOKEN"), "Bearer token for admin requests, such as clearing failures. Empty disables them.")
+	flag.StringVar(&signingKeys, "signing-keys", os.Getenv("SIGNING_KEYS"), "Comma separated id:secret HMAC keys. When set, requests must be signed.")
+	flag.DurationVar(&leaseTTL, "lease-ttl", DefaultLeaseTTL, "How long a worker's claim on a variant lasts if it never releases it.")
+	flag.DurationVar(&failureTTL, "failure-ttl", DefaultFailureTTL, "How long a variant that failed permanently is not resized again.")
+	flag.IntVar(&workers, "workers", 4, "Number of resize worker goroutines.")
+	flag.IntVar(&queueSize, "queue-size", 256, "Maximum resize requests waiting for a worker.")
+	flag.Parse()
+
+	if presetsFile != "" {
+		if err := LoadPresets(presetsFile); err != nil {
+			return fmt.Errorf("Failed to load presets: %w", err)
+		}
+	}
+
+	keys, err := ParseSigningKeys(signingKeys)
+	if err != nil {
+		return fmt.Errorf("Invalid signing keys: %w", err)
+	}
+
+	bp, err := ParseBreakpoints(breakpoints, breakpointPolicy)
+	if err != nil {
+		return fmt.Errorf("Invalid breakpoints: %w", err)
+	}
+
+	serveMode, err := delivery.ParseServeMode(serve)
+	if err != nil {
+		return fmt.Errorf("Invalid serve mode: %w", err)
+	}
+
+	var clientOpts []option.ClientOption
+	if credsFilename != "" {
+		clientOpts = append(clientOpts, option.WithCredentialsFile(credsFilename))
+	}
+
+	fs, err := NewFileSystem(storage, clientOpts...)
+	if err != nil {
+		return fmt.Errorf("Failed to create file system: %w", err)
+	}
+
+	var l logger.Logger = &logger.Standard{}
+	if projectId != "" {
+		cloudClient, cloudLogger, err := NewGCloudLogger(projectId, "asset-delivery", clientOpts...)
+		if err != nil {
+			return fmt.Errorf("Failed to create connection to logger: %w", err)
+		}
+		defer cloudClient.Close()
+		l = cloudLogger
+	}
+
+	messager := NewLocalMessager(queueSize, workers)
+	messager.Logger = l
+	defer messager.Close()
+
+	permitted := strings.Split(allowedHosts, ",")
+	fetcher := &Fetcher{PermittedHosts: permitted, AllowPrivate: allowPrivate}
+	resizer := &worker.Server{
+		Logger:         l,
+		FS:             fs,
+		PermittedHosts: permitted,
+		Fetcher:        fetcher,
+		LeaseTTL:       leaseTTL,
+		FailureTTL:     failureTTL,
+	}
+	if _, err := messager.SubscribeAck(ResizeTopic, func(data []byte) error {
+		return resizer.HandleMessage("", data)
+	}); err != nil {
+		return fmt.Errorf("Failed to subscribe to %s: %w", ResizeTopic, err)
+	}
+
+	server := &delivery.Server{
+		Logger:          l,
+		FS:              fs,
+		PB:              messager,
+		PermittedHosts:  permitted,
+		Prefix:          "resized",
+		SigningKeys:     keys,
+		PresetsOnly:     presetsOnly,
+		Breakpoints:     bp,
+		Serve:           serveMode,
+		SyncTimeout:     syncTimeout,
+		SyncConcurrency: syncConcurrency,
+		LeaseTTL:        leaseTTL,
+		FailureTTL:      failureTTL,
+		PendingTTL:      pendingTTL,
+		AdminToken:      adminToken,
+		Revalidate:      revalidate,
+		Fetcher:         fetcher,
+	}
+	log.Printf("Listening on %s", address)
+	if err := http.ListenAndServe(address, server); err != nil {
+		return fmt.Errorf("Failed to start listening on %s: %w", address, err)
+	}
+	return nil
+}
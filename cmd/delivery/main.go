@@ -4,26 +4,66 @@ import (
 	"flag"
 	"log"
 	"net/http"
+	"os"
 	"strings"
+	"time"
 
 	"google.golang.org/api/option"
 
 	. "github.com/monstercat/asset-delivery"
+	"github.com/monstercat/asset-delivery/delivery"
 )
 
-
-
 func main() {
-	var address, credsFilename, allowedHosts, projectId string
+	var address, credsFilename, allowedHosts, projectId, storage, signingKeys, presetsFile, breakpoints, breakpointPolicy, serve, adminToken string
+	var allowPrivate, presetsOnly bool
+	var syncConcurrency int
+	var syncTimeout, pendingTTL, revalidate, leaseTTL, failureTTL time.Duration
 	flag.StringVar(&address, "address", "0.0.0.0:80", "The binding address for the application.")
 	flag.StringVar(&credsFilename, "credentials", "/secrets/google.json", "The location of the Google JWT file.")
-	flag.StringVar(&allowedHosts, "allow", "", "A comma separated list of domain hosts. An empty value allows any.")
+	flag.StringVar(&allowedHosts, "allow", "", "A comma separated list of domain hosts. An empty value permits none.")
+	flag.BoolVar(&allowPrivate, "allow-private", false, "Allow proxying originals from private, loopback and link-local addresses.")
 	flag.StringVar(&projectId, "project-id", "", "Project ID")
+	flag.StringVar(&storage, "storage", os.Getenv("STORAGE"), "File system backend: gcloud (default), s3 or local.")
+	flag.StringVar(&presetsFile, "presets", os.Getenv("PRESETS"), "Path to a JSON file of named presets.")
+	flag.BoolVar(&presetsOnly, "presets-only", false, "Only accept variants chosen with a preset.")
+	flag.StringVar(&breakpoints, "breakpoints", os.Getenv("BREAKPOINTS"), "Comma separated widths requests are snapped to, e.g. 64,128,256. Empty accepts any width.")
+	flag.StringVar(&breakpointPolicy, "breakpoint-policy", os.Getenv("BREAKPOINT_POLICY"), "snap-up (default) rounds widths up to a breakpoint; strict rejects other widths.")
+	flag.DurationVar(&syncTimeout, "sync-timeout", delivery.DefaultSyncTimeout, "How long sync requests wait for an inline resize.")
+	flag.IntVar(&syncConcurrency, "sync-concurrency", delivery.DefaultSyncConcurrency, "How many inline resizes for sync requests may run at once.")
+	flag.DurationVar(&leaseTTL, "lease-ttl", DefaultLeaseTTL, "How long an inline resize's claim on a variant lasts if it never releases it.")
+	flag.DurationVar(&failureTTL, "failure-ttl", DefaultFailureTTL, "How long a variant whose inline resize failed permanently is not resized again.")
+	flag.DurationVar(&pendingTTL, "pending-ttl", delivery.DefaultPendingTTL, "How long a published resize request is not published again.")
+	flag.DurationVar(&revalidate, "revalidate", 0, "How often served variants are checked for a changed source at the origin. 0 disables it.")
+	flag.StringVar(&serve, "serve", os.Getenv("SERVE"), "redirect (default) redirects to stored objects; proxy streams them.")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("ADMIN_TOKEN"), "Bearer token for admin requests, such as clearing failures. Empty disables them.")
+	flag.StringVar(&signingKeys, "signing-keys", os.Getenv("SIGNING_KEYS"), "Comma separated id:secret HMAC keys. When set, requests must be signed.")
 	flag.Parse()
 
+	if presetsFile != "" {
+		if err := LoadPresets(presetsFile); err != nil {
+			log.Fatalf("Failed to load presets: %s", err.Error())
+		}
+	}
+
+	keys, err := ParseSigningKeys(signingKeys)
+	if err != nil {
+		log.Fatalf("Invalid signing keys: %s", err.Error())
+	}
+
+	bp, err := ParseBreakpoints(breakpoints, breakpointPolicy)
+	if err != nil {
+		log.Fatalf("Invalid breakpoints: %s", err.Error())
+	}
+
+	serveMode, err := delivery.ParseServeMode(serve)
+	if err != nil {
+		log.Fatalf("Invalid serve mode: %s", err.Error())
+	}
+
 	opts := option.WithCredentialsFile(credsFilename)
 
-	fs, err := NewGCloudFileSystem(opts)
+	fs, err := NewFileSystem(storage, opts)
 	if err != nil {
 		log.Fatalf("Failed to create file system: %s", err.Error())
 	}
@@ -44,15 +84,28 @@ func main() {
 
 	pb.Logger = cloudLogger
 
-	server := &Server{
-		Logger:         cloudLogger,
-		FS:             fs,
-		PB:             pb,
-		PermittedHosts: strings.Split(allowedHosts, ","),
-		Prefix:         "resized",
+	permitted := strings.Split(allowedHosts, ",")
+	server := &delivery.Server{
+		Logger:          cloudLogger,
+		FS:              fs,
+		PB:              pb,
+		PermittedHosts:  permitted,
+		Prefix:          "resized",
+		SigningKeys:     keys,
+		PresetsOnly:     presetsOnly,
+		Breakpoints:     bp,
+		Serve:           serveMode,
+		SyncTimeout:     syncTimeout,
+		SyncConcurrency: syncConcurrency,
+		LeaseTTL:        leaseTTL,
+		FailureTTL:      failureTTL,
+		PendingTTL:      pendingTTL,
+		AdminToken:      adminToken,
+		Revalidate:      revalidate,
+		Fetcher:         &Fetcher{PermittedHosts: permitted, AllowPrivate: allowPrivate},
 	}
 	err = http.ListenAndServe(address, server)
 	if err != nil {
 		log.Fatalf("Failed to start listening on %s: %s", address, err.Error())
 	}
-}
\ No newline at end of file
+}
@@ -1,23 +1,44 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"google.golang.org/api/option"
 
 	. "github.com/monstercat/asset-delivery"
+	"github.com/monstercat/asset-delivery/worker"
 )
 
 func main() {
-	var address, credsFilename, projectId string
+	var address, credsFilename, allowedHosts, projectId, storage, mode, subscription string
+	var concurrency int
+	var allowPrivate bool
+	var leaseTTL, failureTTL time.Duration
 	flag.StringVar(&address, "address", "", "The binding address. Defaults to 0.0.0.0:$PORT (Cloud Run sets PORT, default 8080).")
 	flag.StringVar(&credsFilename, "credentials", "", "Path to a Google JWT credentials file. Empty uses ADC.")
+	flag.StringVar(&allowedHosts, "allow", "", "A comma separated list of domain hosts sources may be fetched from. Required.")
+	flag.BoolVar(&allowPrivate, "allow-private", false, "Allow fetching sources from private, loopback and link-local addresses.")
 	flag.StringVar(&projectId, "project-id", "", "GCP project ID (used for Cloud Logging).")
+	flag.StringVar(&storage, "storage", os.Getenv("STORAGE"), "File system backend: gcloud (default), s3 or local.")
+	flag.StringVar(&mode, "mode", "push", "push: serve Pub/Sub push deliveries over HTTP. pull: consume "+ResizeTopic+" through a pull subscription.")
+	flag.StringVar(&subscription, "subscription", os.Getenv("SUBSCRIPTION"), "Pull subscription ID (pull mode). Defaults to the topic name.")
+	flag.IntVar(&concurrency, "concurrency", 4, "Maximum messages processed at once (pull mode).")
+	flag.DurationVar(&failureTTL, "failure-ttl", DefaultFailureTTL, "How long a variant that failed permanently is not resized again.")
+	flag.DurationVar(&leaseTTL, "lease-ttl", DefaultLeaseTTL, "How long a worker's claim on a variant lasts if it never releases it.")
 	flag.Parse()
 
+	if strings.TrimSpace(allowedHosts) == "" {
+		log.Fatal("No hosts are allowed, so every source would be refused. Set -allow.")
+	}
+
 	if address == "" {
 		port := os.Getenv("PORT")
 		if port == "" {
@@ -33,7 +54,7 @@ func main() {
 
 	log.Print("Project ID: ", projectId)
 
-	fs, err := NewGCloudFileSystem(clientOpts...)
+	fs, err := NewFileSystem(storage, clientOpts...)
 	if err != nil {
 		log.Fatalf("Failed to create file system: %s", err.Error())
 	}
@@ -44,13 +65,55 @@ func main() {
 	}
 	defer cloudClient.Close()
 
-	server := &Server{
-		Logger: cloudLogger,
-		FS:     fs,
+	permitted := strings.Split(allowedHosts, ",")
+	server := &worker.Server{
+		Logger:         cloudLogger,
+		FS:             fs,
+		PermittedHosts: permitted,
+		Fetcher:        &Fetcher{PermittedHosts: permitted, AllowPrivate: allowPrivate},
+		LeaseTTL:       leaseTTL,
+		FailureTTL:     failureTTL,
 	}
 
-	log.Printf("Listening on %s", address)
-	if err := http.ListenAndServe(address, server); err != nil {
-		log.Fatalf("Failed to start listening on %s: %s", address, err.Error())
+	switch mode {
+	case "push":
+		log.Printf("Listening on %s", address)
+		if err := http.ListenAndServe(address, server); err != nil {
+			log.Fatalf("Failed to start listening on %s: %s", address, err.Error())
+		}
+	case "pull":
+		pull(server, projectId, subscription, concurrency, clientOpts)
+	default:
+		log.Fatalf("Unknown mode %q", mode)
+	}
+}
+
+// pull consumes ResizeTopic until the process is interrupted. Handler
+// errors with a 5xx status nack the message so the subscription's retry
+// and dead-letter policy apply just as they do to push deliveries.
+func pull(server *worker.Server, projectId, subscription string, concurrency int, clientOpts []option.ClientOption) {
+	pb, err := NewGCloudPubSub(projectId, clientOpts...)
+	if err != nil {
+		log.Fatalf("Failed to create connection to pubsub: %s", err.Error())
 	}
+	defer pb.Close()
+
+	pb.Logger = server.Logger
+	pb.Subscriptions = map[string]string{ResizeTopic: subscription}
+	pb.ReceiveSettings.MaxOutstandingMessages = concurrency
+
+	sub, err := pb.SubscribeAck(ResizeTopic, func(data []byte) error {
+		return server.HandleMessage("", data)
+	})
+	if err != nil {
+		log.Fatalf("Failed to subscribe to %s: %s", ResizeTopic, err.Error())
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	log.Printf("Pulling %s", ResizeTopic)
+	<-ctx.Done()
+
+	log.Print("Shutting down")
+	sub.Unsubscribe()
 }
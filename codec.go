@@ -0,0 +1,227 @@
+package asset_delivery
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/chai2010/webp"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// Codec reads and/or writes one image format. Either Decode or Encode may
+// be nil for formats that are input-only or output-only.
+type Codec struct {
+	// Name is the format name, matching the one image.Decode reports
+	// (e.g. "jpeg"). It is also the value accepted by `encoding=`.
+	Name string
+	// Extensions lists the file extensions, with the leading dot, that
+	// select this codec. The first one names encoded output.
+	Extensions []string
+	// MIMEType is the Content-Type of encoded output.
+	MIMEType string
+
+	Decode func(io.Reader) (image.Image, error)
+	Encode func(io.Writer, image.Image, EncodeOptions) error
+
+	// Rasterize renders vector formats to cover width x height; see
+	// rasterizeSVG. Sniff recognizes such formats from their content,
+	// since the image package cannot.
+	Rasterize func(r io.Reader, width, height int) (image.Image, error)
+	Sniff     func(data []byte) bool
+
+	// DecodeAnimation and EncodeAnimation handle multi-frame images. They
+	// are nil for formats without animation support, in which case only
+	// the first frame of an animation is written.
+	DecodeAnimation func(io.Reader) (*Animation, error)
+	EncodeAnimation func(io.Writer, *Animation, EncodeOptions) error
+
+	// ReadEXIF returns the raw EXIF block of encoded data, or nil.
+	// WriteEXIF returns encoded data with exif embedded. Either is nil for
+	// formats without EXIF support.
+	ReadEXIF  func(data []byte) []byte
+	WriteEXIF func(data, exif []byte) ([]byte, error)
+}
+
+// Extension returns the extension used for encoded output.
+func (c *Codec) Extension() string {
+	if len(c.Extensions) == 0 {
+		return "." + c.Name
+	}
+	return c.Extensions[0]
+}
+
+var codecs = struct {
+	sync.RWMutex
+	byName map[string]*Codec
+	byExt  map[string]*Codec
+}{
+	byName: make(map[string]*Codec),
+	byExt:  make(map[string]*Codec),
+}
+
+// RegisterCodec makes c available to ReaderToImage, ImageToBytes and the
+// `encoding=` validation. Registering a name or extension again replaces
+// the earlier codec.
+func RegisterCodec(c *Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.byName[strings.ToLower(c.Name)] = c
+	for _, ext := range c.Extensions {
+		codecs.byExt[strings.ToLower(ext)] = c
+	}
+}
+
+// CodecByName looks up a codec by format name, e.g. "webp".
+func CodecByName(name string) (*Codec, bool) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	c, ok := codecs.byName[strings.ToLower(name)]
+	return c, ok
+}
+
+// CodecByExtension looks up a codec by file extension, e.g. ".jpg".
+func CodecByExtension(ext string) (*Codec, bool) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	c, ok := codecs.byExt[strings.ToLower(ext)]
+	return c, ok
+}
+
+// vectorCodec returns the codec that rasterizes data, matched by hint's
+// extension or by content.
+func vectorCodec(data []byte, hint string) (*Codec, bool) {
+	if c, ok := CodecByExtension(filepath.Ext(hint)); ok && c.Rasterize != nil {
+		return c, true
+	}
+	codecs.RLock()
+	defer codecs.RUnlock()
+	for _, c := range codecs.byName {
+		if c.Rasterize != nil && c.Sniff != nil && c.Sniff(data) {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// CanEncode reports whether encoding, a format name or extension without
+// the dot (as in `encoding=jpg`), names a codec that can write images.
+func CanEncode(encoding string) bool {
+	c, ok := CodecByExtension("." + strings.TrimPrefix(encoding, "."))
+	return ok && c.Encode != nil
+}
+
+// EncodingNames lists the format names that can be written, sorted.
+func EncodingNames() []string {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	var names []string
+	for name, c := range codecs.byName {
+		if c.Encode != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterCodec(&Codec{
+		Name:       "jpeg",
+		Extensions: []string{".jpeg", ".jpg", ".jfif"},
+		MIMEType:   "image/jpeg",
+		Decode:     jpeg.Decode,
+		Encode: func(w io.Writer, i image.Image, opts EncodeOptions) error {
+			if !opts.Progressive {
+				return jpeg.Encode(w, i, &jpeg.Options{Quality: opts.quality()})
+			}
+			var buf bytes.Buffer
+			if err := jpeg.Encode(&buf, i, &jpeg.Options{Quality: opts.quality()}); err != nil {
+				return err
+			}
+			data, err := progressiveJPEG(buf.Bytes())
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(data)
+			return err
+		},
+		ReadEXIF:  jpegEXIF,
+		WriteEXIF: jpegWithEXIF,
+	})
+	RegisterCodec(&Codec{
+		Name:       "png",
+		Extensions: []string{".png"},
+		MIMEType:   "image/png",
+		Decode:     png.Decode,
+		Encode: func(w io.Writer, i image.Image, opts EncodeOptions) error {
+			enc := png.Encoder{CompressionLevel: pngCompressionLevels[opts.Compression]}
+			return enc.Encode(w, i)
+		},
+		ReadEXIF:  pngEXIF,
+		WriteEXIF: pngWithEXIF,
+	})
+	RegisterCodec(&Codec{
+		Name:       "gif",
+		Extensions: []string{".gif"},
+		MIMEType:   "image/gif",
+		Decode:     gif.Decode,
+		Encode: func(w io.Writer, i image.Image, opts EncodeOptions) error {
+			return gif.Encode(w, i, nil)
+		},
+		DecodeAnimation: decodeGIFAnimation,
+		EncodeAnimation: encodeGIFAnimation,
+	})
+	RegisterCodec(&Codec{
+		Name:       "bmp",
+		Extensions: []string{".bmp"},
+		MIMEType:   "image/bmp",
+		Decode:     bmp.Decode,
+	})
+	RegisterCodec(&Codec{
+		Name:       "tiff",
+		Extensions: []string{".tiff", ".tif"},
+		MIMEType:   "image/tiff",
+		Decode:     tiff.Decode,
+		// A TIFF file is itself the structure EXIF borrows, so its IFD0
+		// carries the orientation.
+		ReadEXIF: func(data []byte) []byte { return data },
+	})
+	RegisterCodec(&Codec{
+		Name:       "svg",
+		Extensions: []string{".svg"},
+		MIMEType:   "image/svg+xml",
+		Decode: func(r io.Reader) (image.Image, error) {
+			return rasterizeSVG(r, 0, 0)
+		},
+		Rasterize: rasterizeSVG,
+		Sniff:     isSVG,
+	})
+	RegisterCodec(&Codec{
+		Name:       "webp",
+		Extensions: []string{".webp"},
+		MIMEType:   "image/webp",
+		Decode:     webp.Decode,
+		Encode: func(w io.Writer, i image.Image, opts EncodeOptions) error {
+			return webp.Encode(w, i, &webp.Options{Quality: float32(opts.quality()), Lossless: opts.Lossless})
+		},
+		ReadEXIF: func(data []byte) []byte {
+			exif, err := webp.GetMetadata(data, "EXIF")
+			if err != nil {
+				return nil
+			}
+			return exif
+		},
+		WriteEXIF: func(data, exif []byte) ([]byte, error) {
+			return webp.SetMetadata(data, exif, "EXIF")
+		},
+	})
+}
@@ -0,0 +1,89 @@
+package asset_delivery
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io"
+	"testing"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+func TestCanEncode(t *testing.T) {
+	for _, enc := range []string{"jpeg", "jpg", "jfif", "png", "webp", "gif", "PNG", ".webp"} {
+		if !CanEncode(enc) {
+			t.Errorf("expected %q to be encodable", enc)
+		}
+	}
+	for _, enc := range []string{"", "tiff", "svg"} {
+		if CanEncode(enc) {
+			t.Errorf("expected %q not to be encodable", enc)
+		}
+	}
+}
+
+func TestRegisterCodec(t *testing.T) {
+	var called bool
+	RegisterCodec(&Codec{
+		Name:       "test-raw",
+		Extensions: []string{".raw"},
+		Encode: func(w io.Writer, i image.Image, opts EncodeOptions) error {
+			called = true
+			_, err := w.Write([]byte("raw"))
+			return err
+		},
+	})
+	defer func() {
+		codecs.Lock()
+		delete(codecs.byName, "test-raw")
+		delete(codecs.byExt, ".raw")
+		codecs.Unlock()
+	}()
+
+	if !CanEncode("raw") {
+		t.Fatal("expected a registered codec to be encodable")
+	}
+	buf, err := ImageToBytes(image.NewNRGBA(image.Rect(0, 0, 1, 1)), ".raw", EncodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !called || !bytes.Equal(buf.Bytes(), []byte("raw")) {
+		t.Fatalf("expected the registered encoder to be used, got %q", buf.Bytes())
+	}
+}
+
+func TestResizeBytes_ReadOnlyFormats(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	for _, name := range []string{"bmp", "tiff"} {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := encodeTestImage(&buf, name, src); err != nil {
+				t.Fatal(err)
+			}
+			opts := ResizeOptions{Width: 20, Location: "https://a/b." + name}
+			if got := opts.DesiredEncoding(); got != FallbackEncoding {
+				t.Fatalf("expected %q, got %q", FallbackEncoding, got)
+			}
+			bits, err := resizeBytes(buf.Bytes(), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := png.Decode(bits)
+			if err != nil {
+				t.Fatalf("expected png output, got %v", err)
+			}
+			if s := img.Bounds().Size(); s != image.Pt(20, 10) {
+				t.Fatalf("expected 20x10, got %v", s)
+			}
+		})
+	}
+}
+
+func encodeTestImage(w io.Writer, format string, img image.Image) error {
+	if format == "bmp" {
+		return bmp.Encode(w, img)
+	}
+	return tiff.Encode(w, img, nil)
+}
@@ -0,0 +1,63 @@
+package delivery
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/monstercat/golib/logger"
+
+	. "github.com/monstercat/asset-delivery"
+)
+
+// failure returns the active failure marker of key, if any. An expired
+// marker is cleared, since the variant is about to be resized again.
+// Markers that cannot be read are ignored, so storage trouble never stops
+// resizing.
+func (s *Server) failure(key string, l logger.Logger) *Failure {
+	f, err := ReadFailure(s.FS, key)
+	if err != nil {
+		l.Log(logger.SeverityWarning, "Could not read failure marker. "+err.Error())
+		return nil
+	}
+	if f == nil {
+		return nil
+	}
+	if !f.Active(time.Now()) {
+		if err := ClearFailure(s.FS, key); err != nil {
+			l.Log(logger.SeverityWarning, "Could not clear failure marker. "+err.Error())
+		}
+		return nil
+	}
+	return f
+}
+
+// clearFailure handles `DELETE /?url=...` with the same variant parameters
+// as a GET, authorized by AdminToken, so the variant is resized on its
+// next request.
+func (s *Server) clearFailure(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+		s.Logger.Log(logger.SeverityWarning, "Rejected admin request without a valid token")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	opts, err := s.resizeOptions(w, r)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	l := &logger.Contextual{
+		Logger:  s.Logger,
+		Context: opts,
+	}
+	if err := ClearFailure(s.FS, opts.ObjectKey()); err != nil {
+		l.Log(logger.SeverityError, "Could not clear failure marker. "+err.Error())
+		WriteError(w, &SystemError{RootError: err, Detail: "Could not clear failure."})
+		return
+	}
+	s.pending.release(opts.ObjectKey())
+	l.Log(logger.SeverityInfo, "Cleared failure marker for "+opts.ObjectKey())
+	w.WriteHeader(http.StatusNoContent)
+}
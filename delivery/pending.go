@@ -0,0 +1,48 @@
+package delivery
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultPendingTTL is how long a published variant is considered in
+// flight. Requests for it in that time do not publish again.
+const DefaultPendingTTL = 30 * time.Second
+
+// pendingTracker remembers which object keys have a resize request in
+// flight, so concurrent requests for a new variant publish it once.
+type pendingTracker struct {
+	mu        sync.Mutex
+	until     map[string]time.Time
+	nextSweep time.Time
+}
+
+// claim reports whether key has no resize in flight and, if so, marks it
+// in flight until now+ttl.
+func (p *pendingTracker) claim(key string, now time.Time, ttl time.Duration) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.until == nil {
+		p.until = make(map[string]time.Time)
+	}
+	if now.After(p.nextSweep) {
+		for k, t := range p.until {
+			if now.After(t) {
+				delete(p.until, k)
+			}
+		}
+		p.nextSweep = now.Add(ttl)
+	}
+	if t, ok := p.until[key]; ok && !now.After(t) {
+		return false
+	}
+	p.until[key] = now.Add(ttl)
+	return true
+}
+
+// release forgets key, e.g. after its publish failed.
+func (p *pendingTracker) release(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.until, key)
+}
@@ -0,0 +1,36 @@
+package delivery
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPendingTracker(t *testing.T) {
+	var p pendingTracker
+	now := time.Unix(1700000000, 0)
+	ttl := 30 * time.Second
+
+	if !p.claim("a", now, ttl) {
+		t.Fatal("expected the first claim to succeed")
+	}
+	if p.claim("a", now.Add(ttl), ttl) {
+		t.Error("expected a claim within the TTL to fail")
+	}
+	if !p.claim("b", now, ttl) {
+		t.Error("expected claims on other keys to succeed")
+	}
+	if !p.claim("a", now.Add(ttl+time.Second), ttl) {
+		t.Error("expected a claim after the TTL to succeed")
+	}
+
+	p.release("b")
+	if !p.claim("b", now, ttl) {
+		t.Error("expected a released key to be claimable")
+	}
+
+	p.claim("c", now, ttl)
+	p.claim("d", now.Add(3*ttl), ttl)
+	if _, ok := p.until["c"]; ok {
+		t.Error("expected expired entries to be swept")
+	}
+}
@@ -0,0 +1,164 @@
+package delivery
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/monstercat/golib/logger"
+
+	. "github.com/monstercat/asset-delivery"
+)
+
+// ServeMode selects how the Server answers once it knows where an asset is.
+type ServeMode string
+
+const (
+	// ServeRedirect redirects to the stored object, or to the origin on a
+	// miss. It is the default.
+	ServeRedirect ServeMode = "redirect"
+	// ServeProxy streams the stored object, or the origin on a miss,
+	// through the Server so clients never see the bucket or origin host.
+	ServeProxy ServeMode = "proxy"
+)
+
+// ParseServeMode parses the -serve flag. An empty value is ServeRedirect.
+func ParseServeMode(v string) (ServeMode, error) {
+	switch m := ServeMode(strings.ToLower(strings.TrimSpace(v))); m {
+	case "", ServeRedirect:
+		return ServeRedirect, nil
+	case ServeProxy:
+		return ServeProxy, nil
+	}
+	return "", fmt.Errorf("unknown serve mode %q", v)
+}
+
+// missCacheControl is sent with originals streamed on a miss, so caches
+// pick up the resized object once it exists.
+const missCacheControl = "no-store"
+
+// proxyObject streams the stored object key, described by info, with its
+// stored headers.
+func (s *Server) proxyObject(w http.ResponseWriter, r *http.Request, key string, info FileInfo, l logger.Logger) {
+	h := w.Header()
+	h.Set("X-Content-Type-Options", "nosniff")
+	if cc := info.CacheControl(); cc != "" {
+		h.Set("Cache-Control", cc)
+	}
+	modified := info.Created()
+	if !modified.IsZero() {
+		h.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	var etag, contentType string
+	size := int64(-1)
+	if o, ok := info.(FileInfoObject); ok {
+		etag, contentType, size = o.ETag(), o.ContentType(), o.Size()
+	}
+	if contentType == "" {
+		// Objects written before Content-Type was stored.
+		if c, ok := CodecByExtension(filepath.Ext(key)); ok {
+			contentType = c.MIMEType
+		}
+	}
+	if etag != "" {
+		h.Set("ETag", etag)
+	}
+	if notModified(r, etag, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	rc, err := s.FS.ReadCloser(key)
+	if err != nil {
+		l.Log(logger.SeverityError, "Could not read object "+key+". "+err.Error())
+		WriteError(w, &SystemError{RootError: err, Detail: "Could not read image."})
+		return
+	}
+	defer rc.Close()
+	if contentType != "" {
+		h.Set("Content-Type", contentType)
+	}
+	if size >= 0 {
+		h.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, rc); err != nil {
+		l.Log(logger.SeverityWarning, "Could not stream object "+key+". "+err.Error())
+	}
+}
+
+// proxyOrigin streams the origin's response for location, passing its
+// status and content headers through. Only image responses are streamed,
+// so the delivery host never serves the origin's HTML or scripts; anything
+// else is redirected to instead.
+func (s *Server) proxyOrigin(w http.ResponseWriter, r *http.Request, location string, l logger.Logger) {
+	res, err := s.fetcher().Open(location, nil)
+	if err != nil {
+		l.Log(logger.SeverityWarning, "Could not fetch origin. "+err.Error())
+		WriteError(w, &ParamError{Param: "url", Detail: fmt.Sprintf("Could not get image: %s", location), RootError: err})
+		return
+	}
+	defer res.Body.Close()
+	if !proxiable(res) {
+		l.Log(logger.SeverityWarning, fmt.Sprintf("Not streaming origin response %d %q.", res.StatusCode, res.Header.Get("Content-Type")))
+		http.Redirect(w, r, location, http.StatusTemporaryRedirect)
+		return
+	}
+
+	h := w.Header()
+	for _, k := range []string{"Content-Type", "Content-Length", "ETag", "Last-Modified"} {
+		if v := res.Header.Get(k); v != "" {
+			h.Set(k, v)
+		}
+	}
+	h.Set("Cache-Control", missCacheControl)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(res.StatusCode)
+	if _, err := io.Copy(w, res.Body); err != nil {
+		l.Log(logger.SeverityWarning, "Could not stream origin. "+err.Error())
+	}
+}
+
+// proxiable reports whether an origin response is safe to stream from the
+// delivery host: a 2xx or 304 with an image type other than SVG, which may
+// carry scripts.
+func proxiable(res *http.Response) bool {
+	if res.StatusCode == http.StatusNotModified {
+		return true
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "image/") && mediaType != "image/svg+xml"
+}
+
+// notModified evaluates If-None-Match, or If-Modified-Since when that is
+// absent, against the stored object.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etag == "" {
+			return false
+		}
+		for _, v := range strings.Split(inm, ",") {
+			v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+			if v == "*" || v == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modified.IsZero() {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(ims)
+}
@@ -0,0 +1,57 @@
+package delivery
+
+import (
+	"time"
+
+	"github.com/monstercat/golib/logger"
+
+	. "github.com/monstercat/asset-delivery"
+)
+
+// revalidatePrefix keeps revalidation claims apart from publish claims in
+// the pending tracker.
+const revalidatePrefix = "revalidate\x00"
+
+// revalidate checks, in the background, whether the source of a served
+// variant has changed at the origin once Revalidate has passed since it
+// was last confirmed, and publishes a resize when it has. The check is
+// made once per source, whichever of its variants is served; variants
+// written before a change the sidecar records are published without
+// asking the origin again. The current variant keeps being served until
+// the resize replaces it.
+func (s *Server) revalidate(opts ResizeOptions, info FileInfo, l logger.Logger) {
+	now := time.Now()
+	// The variant's write time is a lower bound on the last check, so
+	// fresh variants skip reading the sidecar.
+	if now.Sub(info.Created()) < s.Revalidate {
+		return
+	}
+	key := opts.SourceKey()
+	source, err := ReadSourceInfo(s.FS, key)
+	if err != nil {
+		l.Log(logger.SeverityWarning, "Could not read source info. "+err.Error())
+		return
+	}
+	if source != nil && source.Outdates(info.Created()) {
+		l.Log(logger.SeverityInfo, "Source changed at origin; resizing "+opts.ObjectKey())
+		s.sendResize(opts, l)
+		return
+	}
+	if source != nil && now.Sub(source.Checked) < s.Revalidate {
+		return
+	}
+	if !s.pending.claim(revalidatePrefix+key, now, s.Revalidate) {
+		return
+	}
+	go func() {
+		changed, err := RevalidateSource(s.FS, s.fetcher(), key, opts.Location)
+		if err != nil {
+			l.Log(logger.SeverityWarning, "Could not revalidate source. "+err.Error())
+			return
+		}
+		if changed {
+			l.Log(logger.SeverityInfo, "Source changed at origin; resizing "+opts.ObjectKey())
+			s.sendResize(opts, l)
+		}
+	}()
+}
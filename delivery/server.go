@@ -0,0 +1,327 @@
+// Package delivery implements the HTTP server that redirects requests to,
+// or streams, resized assets and publishes resize requests for missing
+// ones.
+package delivery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/marcw/cachecontrol"
+	"github.com/monstercat/golib/logger"
+
+	. "github.com/monstercat/asset-delivery"
+)
+
+type Server struct {
+	logger.Logger
+	FS             FileSystem
+	PB             Publisher
+	PermittedHosts []string
+	Prefix         string
+	// SigningKeys, when not empty, requires every request to be signed
+	// with one of them; see SignURL.
+	SigningKeys SigningKeys
+	// PresetsOnly rejects requests that choose a variant with anything but
+	// a registered preset.
+	PresetsOnly bool
+	// Breakpoints, when set, snaps or restricts requested widths.
+	Breakpoints *Breakpoints
+	// Serve selects redirects (the default) or streaming responses.
+	Serve ServeMode
+	// Fetcher streams originals in ServeProxy mode and downloads sources
+	// for `sync` requests. It defaults to a Fetcher limited to
+	// PermittedHosts.
+	Fetcher *Fetcher
+	// SyncTimeout bounds inline resizes for `sync` requests. It defaults
+	// to DefaultSyncTimeout.
+	SyncTimeout time.Duration
+	// SyncConcurrency caps the inline resizes running at once. It defaults
+	// to DefaultSyncConcurrency.
+	SyncConcurrency int
+	// FailureTTL is how long a variant whose inline resize failed with a
+	// 4xx error is not resized again; see the worker's FailureTTL.
+	FailureTTL time.Duration
+	// LeaseTTL is used for inline resizes when FS is a Leaser; see the
+	// worker's LeaseTTL. It defaults to DefaultLeaseTTL.
+	LeaseTTL time.Duration
+	// PendingTTL is how long a published variant is not published again;
+	// see DefaultPendingTTL.
+	PendingTTL time.Duration
+	// Revalidate, when set, is how often a served variant's source is
+	// checked against the origin; see revalidate.
+	Revalidate time.Duration
+	// AdminToken, when set, allows DELETE requests carrying it as a bearer
+	// token to clear a variant's failure marker; see clearFailure.
+	AdminToken string
+
+	once     sync.Once
+	syncOnce sync.Once
+	slots    chan struct{}
+	pending  pendingTracker
+}
+
+func (s *Server) pendingTTL() time.Duration {
+	if s.PendingTTL > 0 {
+		return s.PendingTTL
+	}
+	return DefaultPendingTTL
+}
+
+func (s *Server) fetcher() *Fetcher {
+	s.once.Do(func() {
+		if s.Fetcher == nil {
+			s.Fetcher = &Fetcher{PermittedHosts: s.PermittedHosts}
+		}
+	})
+	return s.Fetcher
+}
+
+// HostPermitted reports whether host matches one of PermittedHosts; see
+// the package-level HostPermitted.
+func (s *Server) HostPermitted(host string) bool {
+	return HostPermitted(s.PermittedHosts, host)
+}
+
+// TODO: generate a request id that can be passed along for all requests.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete && s.AdminToken != "" {
+		s.clearFailure(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		s.Logger.Log(logger.SeverityWarning, "Request received with method "+r.Method)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if len(s.SigningKeys) > 0 {
+		if err := s.SigningKeys.Verify(r.URL.Query(), time.Now()); err != nil {
+			s.Logger.Log(logger.SeverityWarning, "Rejected request signature: "+err.Error())
+			WriteError(w, &SignatureError{RootError: err})
+			return
+		}
+	}
+	if s.PresetsOnly {
+		if err := CheckPresetOnly(r.URL.Query()); err != nil {
+			WriteError(w, err)
+			return
+		}
+	}
+	opts, err := s.resizeOptions(w, r)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	l := &logger.Contextual{
+		Logger:  s.Logger,
+		Context: opts,
+	}
+
+	if !s.HostPermitted(opts.URL.Host) {
+		l.Log(logger.SeverityWarning, "Invalid host: "+opts.URL.Host)
+		WriteError(w, &ParamError{Param: "url", Detail: "Host is not permitted to perform this action."})
+		return
+	}
+	info, state, err := s.lookup(opts)
+	if err != nil {
+		if v, ok := err.(RootError); ok && v.Root() != nil {
+			l.Log(logger.SeverityWarning, "Could not check needs resizing. "+err.Error()+"; "+v.Root().Error())
+		} else {
+			l.Log(logger.SeverityWarning, "Could not check needs resizing. "+err.Error())
+		}
+		WriteError(w, err)
+		return
+	}
+	switch state {
+	case stale:
+		s.sendResize(opts.ResizeOptions, l)
+		s.serveObject(w, r, opts.ObjectKey(), info, l)
+		return
+	case fresh:
+		if s.Revalidate > 0 {
+			s.revalidate(opts.ResizeOptions, info, l)
+		}
+		s.serveObject(w, r, opts.ObjectKey(), info, l)
+		return
+	}
+	if f := s.failure(opts.ObjectKey(), l); f != nil {
+		l.Log(logger.SeverityInfo, fmt.Sprintf("Not resizing until %s after failure: %s", f.RetryAfter.Format(time.RFC3339), f.Reason))
+		s.serveOrigin(w, r, opts.Location, l)
+		return
+	}
+	if opts.Sync && s.resizeSync(opts.ResizeOptions, l) {
+		s.serveObject(w, r, opts.ObjectKey(), nil, l)
+		return
+	}
+
+	s.sendResize(opts.ResizeOptions, l)
+	s.serveOrigin(w, r, opts.Location, l)
+}
+
+// resizeOptions parses the variant r asks for.
+func (s *Server) resizeOptions(w http.ResponseWriter, r *http.Request) (ResizeOptionsProcessed, error) {
+	opts, err := NewResizeOptionsFromQuery(r.URL.Query())
+	if err != nil {
+		return opts, err
+	}
+	opts.Prefix = s.Prefix
+	opts.RecordSource = s.Revalidate > 0
+	if err := s.Breakpoints.Apply(&opts.ResizeOptions); err != nil {
+		return opts, err
+	}
+	if opts.Encoding == EncodingAuto {
+		// Resolve before anything reads the object key so each negotiated
+		// format is stored, and published, as its own variant. Caches must
+		// key the redirect on Accept as well.
+		opts.Encoding = NegotiateEncoding(r.Header.Get("Accept"))
+		w.Header().Add("Vary", "Accept")
+	}
+	return opts, nil
+}
+
+// serveOrigin redirects to, or streams, the original at location.
+func (s *Server) serveOrigin(w http.ResponseWriter, r *http.Request, location string, l logger.Logger) {
+	if s.Serve == ServeProxy {
+		s.proxyOrigin(w, r, location, l)
+		return
+	}
+	http.Redirect(w, r, location, http.StatusTemporaryRedirect)
+}
+
+// serveObject redirects to, or streams, the stored object key. info may be
+// nil when it has not been looked up yet.
+func (s *Server) serveObject(w http.ResponseWriter, r *http.Request, key string, info FileInfo, l logger.Logger) {
+	if s.Serve != ServeProxy {
+		http.Redirect(w, r, s.FS.ObjectURL(key), http.StatusPermanentRedirect)
+		return
+	}
+	if info == nil {
+		var err error
+		if info, err = s.FS.Info(key); err != nil {
+			l.Log(logger.SeverityError, "Could not read object info "+key+". "+err.Error())
+			WriteError(w, &SystemError{RootError: err, Detail: "Could not read image."})
+			return
+		}
+	}
+	s.proxyObject(w, r, key, info, l)
+}
+
+// sendResize sends the resize commands quietly. A variant already sent
+// within PendingTTL is not sent again.
+// TODO: pass in publish topic through an environment variable
+func (s *Server) sendResize(opts ResizeOptions, l logger.Logger) {
+	key := opts.ObjectKey()
+	if !s.pending.claim(key, time.Now(), s.pendingTTL()) {
+		l.Log(logger.SeverityInfo, "Resize request already pending for "+key)
+		return
+	}
+	// Send resize request
+	b, err := json.Marshal(opts)
+	if err != nil {
+		s.pending.release(key)
+		l.Log(logger.SeverityError, fmt.Sprintf("Could not marshal resize options. %s", err))
+		return
+	}
+	l.Log(logger.SeverityInfo, "Sending resize request on "+ResizeTopic)
+	if err := s.PB.Publish(ResizeTopic, b); err != nil {
+		s.pending.release(key)
+		l.Log(logger.SeverityError, fmt.Sprintf("Could not send resize command. %s", err))
+		return
+	}
+	l.Log(logger.SeverityInfo, "Resize request sent "+ResizeTopic)
+}
+
+// freshness is how a stored variant may be used.
+type freshness int
+
+const (
+	// fresh variants are served as they are.
+	fresh freshness = iota
+	// stale variants are past their lifetime but within
+	// stale-while-revalidate, so they are served while a refresh is
+	// published.
+	stale
+	// expired variants are handled as if they were missing.
+	expired
+)
+
+// freshnessOf applies the Cache-Control stored with a variant the way a
+// shared cache would. s-maxage takes precedence over max-age.
+// stale-while-revalidate extends its use, unless must-revalidate or
+// proxy-revalidate forbid serving it stale. A variant without a lifetime
+// never expires.
+//
+// no-store, no-cache without field names and zero lifetimes are kept on
+// the object for the caches in front of it, but they never let a variant
+// be reused as it is. Treated as expired, the variant would be resized on
+// every request and never served, so it is stale instead: served while a
+// refresh is published, at most once per PendingTTL.
+func freshnessOf(info FileInfo, now time.Time) freshness {
+	control := cachecontrol.Parse(info.CacheControl())
+	if control.NoStore() {
+		return stale
+	}
+	lifetime := directiveSeconds(control, "s-maxage")
+	if lifetime < 0 {
+		lifetime = directiveSeconds(control, "max-age")
+	}
+	if noCache, fields := control.NoCache(); noCache && fields == "" {
+		lifetime = 0
+	}
+	if lifetime < 0 {
+		return fresh
+	}
+	if lifetime == 0 {
+		return stale
+	}
+	age := now.Sub(info.Created())
+	if age < lifetime {
+		return fresh
+	}
+	if control.MustRevalidate() || control.ProxyRevalidate() {
+		return expired
+	}
+	if swr := directiveSeconds(control, "stale-while-revalidate"); swr > 0 && age < lifetime+swr {
+		return stale
+	}
+	return expired
+}
+
+// directiveSeconds returns a delta-seconds directive, or -1 when it is
+// missing or invalid.
+func directiveSeconds(control cachecontrol.CacheControl, name string) time.Duration {
+	v, ok := control[name]
+	if !ok {
+		return -1
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return time.Duration(n) * time.Second
+}
+
+func (s *Server) NeedsResizing(opts ResizeOptionsProcessed) (bool, error) {
+	_, state, err := s.lookup(opts)
+	return state != fresh, err
+}
+
+// lookup returns the stored object's info, when there is one, and its
+// freshness. Missing objects and forced requests are expired.
+func (s *Server) lookup(opts ResizeOptionsProcessed) (FileInfo, freshness, error) {
+	if opts.Force {
+		return nil, expired, nil
+	}
+	info, err := s.FS.Info(opts.ObjectKey())
+	if err != nil && err != ErrNoFile {
+		return nil, expired, &SystemError{RootError: err, Detail: "Could not check if image already exists."}
+	} else if info == nil {
+		return nil, expired, nil
+	}
+	return info, freshnessOf(info, time.Now()), nil
+}
@@ -0,0 +1,1020 @@
+package delivery
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/monstercat/golib/logger"
+
+	. "github.com/monstercat/asset-delivery"
+	"github.com/monstercat/asset-delivery/assetdeliverytest"
+)
+
+type noopLogger struct{}
+
+func (noopLogger) Log(_ logger.Severity, _ any) {}
+
+const testOrigin = "https://cdn.monstercat.com/art/cover.png"
+
+func newTestServer() (*Server, *assetdeliverytest.FileSystem, *assetdeliverytest.Messager) {
+	fs := assetdeliverytest.NewFileSystem()
+	pb := assetdeliverytest.NewMessager()
+	return &Server{
+		Logger: noopLogger{},
+		FS:     fs,
+		PB:     pb,
+		Prefix: "resized",
+	}, fs, pb
+}
+
+func testRequest(query url.Values) *http.Request {
+	return httptest.NewRequest(http.MethodGet, "/?"+query.Encode(), nil)
+}
+
+func testObjectKey(t *testing.T, query url.Values) string {
+	t.Helper()
+	opts, err := NewResizeOptionsFromQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Prefix = "resized"
+	return opts.ObjectKey()
+}
+
+func TestServeHTTP_MissPublishesAndRedirectsToOrigin(t *testing.T) {
+	s, _, pb := newTestServer()
+	query := url.Values{"url": {testOrigin}, "width": {"100"}, "encoding": {"webp"}}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, testRequest(query))
+
+	if rec.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected 307, got %d", rec.Code)
+	}
+	if loc := rec.Header().Get("Location"); loc != testOrigin {
+		t.Fatalf("expected redirect to origin, got %q", loc)
+	}
+
+	msgs := pb.PublishedOn(ResizeTopic)
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 resize message, got %d", len(msgs))
+	}
+	var opts ResizeOptions
+	if err := json.Unmarshal(msgs[0].Data, &opts); err != nil {
+		t.Fatal(err)
+	}
+	if opts.Width != 100 || opts.Encoding != "webp" || opts.Location != testOrigin || opts.Prefix != "resized" {
+		t.Fatalf("unexpected resize options %+v", opts)
+	}
+}
+
+func TestServeHTTP_HitRedirectsToObject(t *testing.T) {
+	s, fs, pb := newTestServer()
+	query := url.Values{"url": {testOrigin}, "width": {"100"}, "encoding": {"webp"}}
+	key := testObjectKey(t, query)
+	fs.Put(key, []byte("resized"), "max-age=3600", time.Now())
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, testRequest(query))
+
+	if rec.Code != http.StatusPermanentRedirect {
+		t.Fatalf("expected 308, got %d", rec.Code)
+	}
+	if loc := rec.Header().Get("Location"); loc != fs.ObjectURL(key) {
+		t.Fatalf("expected redirect to %q, got %q", fs.ObjectURL(key), loc)
+	}
+	if n := len(pb.Published()); n != 0 {
+		t.Fatalf("expected no resize messages, got %d", n)
+	}
+}
+
+func TestServeHTTP_AutoEncodingHitUsesNegotiatedVariant(t *testing.T) {
+	s, fs, pb := newTestServer()
+	key := testObjectKey(t, url.Values{"url": {testOrigin}, "width": {"100"}, "encoding": {"webp"}})
+	fs.Put(key, []byte("resized"), "max-age=3600", time.Now())
+
+	req := testRequest(url.Values{"url": {testOrigin}, "width": {"100"}, "encoding": {"auto"}})
+	req.Header.Set("Accept", "image/avif,image/webp,image/*,*/*;q=0.8")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusPermanentRedirect {
+		t.Fatalf("expected 308, got %d", rec.Code)
+	}
+	if loc := rec.Header().Get("Location"); loc != fs.ObjectURL(key) {
+		t.Fatalf("expected redirect to %q, got %q", fs.ObjectURL(key), loc)
+	}
+	if v := rec.Header().Get("Vary"); v != "Accept" {
+		t.Fatalf("expected Vary: Accept, got %q", v)
+	}
+	if n := len(pb.Published()); n != 0 {
+		t.Fatalf("expected no resize messages, got %d", n)
+	}
+}
+
+func TestServeHTTP_AutoEncodingFallsBackToSource(t *testing.T) {
+	s, _, pb := newTestServer()
+
+	req := testRequest(url.Values{"url": {testOrigin}, "width": {"100"}, "encoding": {"auto"}})
+	req.Header.Set("Accept", "image/png,image/*;q=0.8,*/*;q=0.5")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected 307, got %d", rec.Code)
+	}
+	if loc := rec.Header().Get("Location"); loc != testOrigin {
+		t.Fatalf("expected redirect to origin, got %q", loc)
+	}
+	if v := rec.Header().Get("Vary"); v != "Accept" {
+		t.Fatalf("expected Vary: Accept, got %q", v)
+	}
+	msgs := pb.PublishedOn(ResizeTopic)
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 resize message, got %d", len(msgs))
+	}
+	var opts ResizeOptions
+	if err := json.Unmarshal(msgs[0].Data, &opts); err != nil {
+		t.Fatal(err)
+	}
+	if opts.Encoding != "" || opts.ObjectKey() != testObjectKey(t, url.Values{"url": {testOrigin}, "width": {"100"}}) {
+		t.Fatalf("expected the source encoding, got %+v", opts)
+	}
+}
+
+func TestServeHTTP_ExpiredPublishes(t *testing.T) {
+	s, fs, pb := newTestServer()
+	query := url.Values{"url": {testOrigin}, "width": {"100"}}
+	key := testObjectKey(t, query)
+	fs.Put(key, []byte("resized"), "max-age=60", time.Now().Add(-time.Hour))
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, testRequest(query))
+
+	if rec.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected 307, got %d", rec.Code)
+	}
+	if n := len(pb.PublishedOn(ResizeTopic)); n != 1 {
+		t.Fatalf("expected 1 resize message, got %d", n)
+	}
+}
+
+func TestServeHTTP_StaleWhileRevalidateServesAndPublishes(t *testing.T) {
+	s, fs, pb := newTestServer()
+	query := url.Values{"url": {testOrigin}, "width": {"100"}}
+	key := testObjectKey(t, query)
+	fs.Put(key, []byte("resized"), "max-age=60, stale-while-revalidate=600", time.Now().Add(-2*time.Minute))
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, testRequest(query))
+		if rec.Code != http.StatusPermanentRedirect {
+			t.Fatalf("expected 308, got %d", rec.Code)
+		}
+	}
+	if n := len(pb.PublishedOn(ResizeTopic)); n != 1 {
+		t.Fatalf("expected 1 resize message, got %d", n)
+	}
+}
+
+type fakeInfo struct {
+	cc      string
+	created time.Time
+}
+
+func (f fakeInfo) CacheControl() string { return f.cc }
+func (f fakeInfo) Created() time.Time   { return f.created }
+
+func TestFreshnessOf(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		cc    string
+		age   time.Duration
+		state freshness
+	}{
+		{"", time.Hour, fresh},
+		{"public", time.Hour, fresh},
+		{"max-age=60", 30 * time.Second, fresh},
+		{"max-age=60", 2 * time.Minute, expired},
+		{"max-age=0", 0, stale},
+		{"max-age=0, must-revalidate", time.Hour, stale},
+		{"max-age=60, s-maxage=600", 2 * time.Minute, fresh},
+		{"max-age=600, s-maxage=60", 2 * time.Minute, expired},
+		{"max-age=60, stale-while-revalidate=600", 2 * time.Minute, stale},
+		{"max-age=60, stale-while-revalidate=600", time.Hour, expired},
+		{"s-maxage=60, stale-while-revalidate=600", 2 * time.Minute, stale},
+		{"max-age=60, stale-while-revalidate=600, must-revalidate", 2 * time.Minute, expired},
+		{"max-age=60, stale-while-revalidate=600, proxy-revalidate", 2 * time.Minute, expired},
+		{"no-store", 0, stale},
+		{"no-store, max-age=3600", 0, stale},
+		{"no-cache", time.Hour, stale},
+		{"no-cache, stale-while-revalidate=600", time.Second, stale},
+		{`no-cache="Set-Cookie", max-age=3600`, time.Minute, fresh},
+		{"max-age=oops", time.Hour, fresh},
+	}
+	for _, tt := range tests {
+		info := fakeInfo{cc: tt.cc, created: now.Add(-tt.age)}
+		if got := freshnessOf(info, now); got != tt.state {
+			t.Errorf("%q at age %s: expected %d, got %d", tt.cc, tt.age, tt.state, got)
+		}
+	}
+}
+
+func TestServeHTTP_ForcePublishes(t *testing.T) {
+	s, fs, pb := newTestServer()
+	query := url.Values{"url": {testOrigin}, "width": {"100"}}
+	fs.Put(testObjectKey(t, query), []byte("resized"), "max-age=3600", time.Now())
+
+	query.Set("force", "1")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, testRequest(query))
+
+	if rec.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected 307, got %d", rec.Code)
+	}
+	if n := len(pb.PublishedOn(ResizeTopic)); n != 1 {
+		t.Fatalf("expected 1 resize message, got %d", n)
+	}
+}
+
+func TestServeHTTP_InfoErrorReturns500(t *testing.T) {
+	s, fs, pb := newTestServer()
+	fs.FailOn(assetdeliverytest.OpInfo, "", errors.New("storage unavailable"))
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, testRequest(url.Values{"url": {testOrigin}, "width": {"100"}}))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", rec.Code)
+	}
+	if n := len(pb.Published()); n != 0 {
+		t.Fatalf("expected no resize messages, got %d", n)
+	}
+}
+
+func TestServeHTTP_PublishErrorStillRedirects(t *testing.T) {
+	s, _, pb := newTestServer()
+	pb.FailPublish(errors.New("pubsub unavailable"))
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, testRequest(url.Values{"url": {testOrigin}, "width": {"100"}}))
+
+	if rec.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected 307, got %d", rec.Code)
+	}
+}
+
+func TestServeHTTP_RejectsHostNotPermitted(t *testing.T) {
+	s, _, pb := newTestServer()
+	s.PermittedHosts = []string{"*.monstercat.com"}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, testRequest(url.Values{"url": {"https://evil.example.org/a.png"}, "width": {"100"}}))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+	if n := len(pb.Published()); n != 0 {
+		t.Fatalf("expected no resize messages, got %d", n)
+	}
+}
+
+func TestServeHTTP_RejectsUnsupportedEncoding(t *testing.T) {
+	s, _, pb := newTestServer()
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, testRequest(url.Values{"url": {testOrigin}, "width": {"100"}, "encoding": {"tiff"}}))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+	if n := len(pb.Published()); n != 0 {
+		t.Fatalf("expected no resize messages, got %d", n)
+	}
+}
+
+func TestServeHTTP_Signatures(t *testing.T) {
+	key := []byte("secret")
+	signed := url.Values{"url": {testOrigin}, "width": {"100"}}
+	SignQuery(signed, "k1", key, time.Now().Add(time.Hour))
+	tampered := url.Values{}
+	for k, v := range signed {
+		tampered[k] = v
+	}
+	tampered.Set("width", "4000")
+
+	cases := []struct {
+		Name   string
+		Query  url.Values
+		Status int
+	}{
+		{"signed", signed, http.StatusTemporaryRedirect},
+		{"unsigned", url.Values{"url": {testOrigin}, "width": {"100"}}, http.StatusForbidden},
+		{"tampered", tampered, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			s, _, pb := newTestServer()
+			s.SigningKeys = SigningKeys{"k1": key}
+
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, testRequest(c.Query))
+
+			if rec.Code != c.Status {
+				t.Fatalf("expected %d, got %d", c.Status, rec.Code)
+			}
+			if published := len(pb.Published()) > 0; published != (c.Status == http.StatusTemporaryRedirect) {
+				t.Fatalf("unexpected resize messages %v", pb.Published())
+			}
+		})
+	}
+}
+
+func TestServeHTTP_PresetsOnly(t *testing.T) {
+	if err := RegisterPreset("delivery-test", Preset{"width": "100", "encoding": "webp"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		Name   string
+		Query  url.Values
+		Status int
+	}{
+		{"preset", url.Values{"url": {testOrigin}, "preset": {"delivery-test"}}, http.StatusTemporaryRedirect},
+		{"explicit parameters", url.Values{"url": {testOrigin}, "width": {"100"}}, http.StatusBadRequest},
+		{"preset with overrides", url.Values{"url": {testOrigin}, "preset": {"delivery-test"}, "width": {"4000"}}, http.StatusBadRequest},
+		{"preset with force", url.Values{"url": {testOrigin}, "preset": {"delivery-test"}, "force": {"1"}}, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			s, _, pb := newTestServer()
+			s.PresetsOnly = true
+
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, testRequest(c.Query))
+
+			if rec.Code != c.Status {
+				t.Fatalf("expected %d, got %d", c.Status, rec.Code)
+			}
+			if published := len(pb.Published()) > 0; published != (c.Status == http.StatusTemporaryRedirect) {
+				t.Fatalf("unexpected resize messages %v", pb.Published())
+			}
+		})
+	}
+}
+
+func TestServeHTTP_BreakpointsShareVariants(t *testing.T) {
+	s, fs, pb := newTestServer()
+	s.Breakpoints = &Breakpoints{Widths: []uint{64, 128, 256}, Policy: BreakpointSnapUp}
+	key := testObjectKey(t, url.Values{"url": {testOrigin}, "width": {"128"}})
+	fs.Put(key, []byte("resized"), "max-age=3600", time.Now())
+
+	for _, width := range []string{"65", "100", "128"} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, testRequest(url.Values{"url": {testOrigin}, "width": {width}}))
+		if rec.Code != http.StatusPermanentRedirect {
+			t.Fatalf("width %s: expected 308, got %d", width, rec.Code)
+		}
+		if loc := rec.Header().Get("Location"); loc != fs.ObjectURL(key) {
+			t.Fatalf("width %s: expected redirect to %q, got %q", width, fs.ObjectURL(key), loc)
+		}
+	}
+	if n := len(pb.Published()); n != 0 {
+		t.Fatalf("expected no resize messages, got %d", n)
+	}
+}
+
+func TestServeHTTP_CoalescesPendingPublishes(t *testing.T) {
+	s, _, pb := newTestServer()
+	query := url.Values{"url": {testOrigin}, "width": {"100"}}
+
+	pb.FailPublish(errors.New("pubsub unavailable"))
+	s.ServeHTTP(httptest.NewRecorder(), testRequest(query))
+	pb.FailPublish(nil)
+
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, testRequest(query))
+		if rec.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("expected 307, got %d", rec.Code)
+		}
+	}
+	if n := len(pb.PublishedOn(ResizeTopic)); n != 1 {
+		t.Fatalf("expected 1 resize message after a failed publish, got %d", n)
+	}
+
+	other := url.Values{"url": {testOrigin}, "width": {"200"}}
+	s.ServeHTTP(httptest.NewRecorder(), testRequest(other))
+	if n := len(pb.PublishedOn(ResizeTopic)); n != 2 {
+		t.Fatalf("expected other variants to publish, got %d messages", n)
+	}
+}
+
+func TestServeHTTP_FailureMarkerSkipsPublish(t *testing.T) {
+	query := url.Values{"url": {testOrigin}, "width": {"100"}}
+	cases := []struct {
+		Name      string
+		At        time.Time
+		Published int
+		Kept      bool
+	}{
+		{"active", time.Now(), 0, true},
+		{"expired", time.Now().Add(-2 * time.Hour), 1, false},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			s, fs, pb := newTestServer()
+			err := WriteFailure(fs, testObjectKey(t, query), NewFailure(&ParamError{Param: "url", Detail: "Not found"}, c.At, time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, testRequest(query))
+
+			if rec.Code != http.StatusTemporaryRedirect {
+				t.Fatalf("expected 307, got %d", rec.Code)
+			}
+			if loc := rec.Header().Get("Location"); loc != testOrigin {
+				t.Fatalf("expected redirect to origin, got %q", loc)
+			}
+			if n := len(pb.PublishedOn(ResizeTopic)); n != c.Published {
+				t.Fatalf("expected %d resize messages, got %d", c.Published, n)
+			}
+			if f, err := ReadFailure(fs, testObjectKey(t, query)); err != nil || (f != nil) != c.Kept {
+				t.Fatalf("expected the marker kept: %t, got %+v, %v", c.Kept, f, err)
+			}
+		})
+	}
+}
+
+func TestServeHTTP_AdminClearsFailure(t *testing.T) {
+	query := url.Values{"url": {testOrigin}, "width": {"100"}}
+	cases := []struct {
+		Name   string
+		Token  string
+		Header string
+		Status int
+	}{
+		{"valid token", "secret", "Bearer secret", http.StatusNoContent},
+		{"wrong token", "secret", "Bearer guess", http.StatusForbidden},
+		{"missing token", "secret", "", http.StatusForbidden},
+		{"admin disabled", "", "Bearer ", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			s, fs, pb := newTestServer()
+			s.AdminToken = c.Token
+			key := testObjectKey(t, query)
+			if err := WriteFailure(fs, key, NewFailure(errors.New("not an image"), time.Now(), time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodDelete, "/?"+query.Encode(), nil)
+			if c.Header != "" {
+				req.Header.Set("Authorization", c.Header)
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != c.Status {
+				t.Fatalf("expected %d, got %d", c.Status, rec.Code)
+			}
+
+			f, err := ReadFailure(fs, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cleared := f == nil; cleared != (c.Status == http.StatusNoContent) {
+				t.Fatalf("unexpected failure marker %+v", f)
+			}
+			s.ServeHTTP(httptest.NewRecorder(), testRequest(query))
+			if published := len(pb.Published()) > 0; published != (c.Status == http.StatusNoContent) {
+				t.Fatalf("unexpected resize messages %v", pb.Published())
+			}
+		})
+	}
+}
+
+func testSourceKey(t *testing.T, query url.Values) string {
+	t.Helper()
+	opts, err := NewResizeOptionsFromQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Prefix = "resized"
+	return opts.SourceKey()
+}
+
+func TestServeHTTP_RevalidatesChangedSource(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Source    string
+		Published int
+	}{
+		{"unchanged", "cover", 0},
+		{"changed", "new cover", 2},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			var mu sync.Mutex
+			hits := 0
+			origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				hits++
+				mu.Unlock()
+				w.Write([]byte(c.Source))
+			}))
+			defer origin.Close()
+
+			s, fs, pb := newTestServer()
+			s.Fetcher = &Fetcher{AllowPrivate: true}
+			s.Revalidate = time.Minute
+			var queries []url.Values
+			for _, width := range []string{"100", "200"} {
+				query := url.Values{"url": {origin.URL + "/cover.png"}, "width": {width}}
+				fs.Put(testObjectKey(t, query), []byte("resized"), "max-age=86400", time.Now().Add(-time.Hour))
+				queries = append(queries, query)
+			}
+			key := testSourceKey(t, queries[0])
+			sum := sha256.Sum256([]byte("cover"))
+			old := &SourceInfo{SHA256: hex.EncodeToString(sum[:]), Checked: time.Now().Add(-time.Hour)}
+			if err := WriteSourceInfo(fs, key, old); err != nil {
+				t.Fatal(err)
+			}
+
+			// Every variant of the source shares one check of the origin.
+			for _, query := range queries {
+				rec := httptest.NewRecorder()
+				s.ServeHTTP(rec, testRequest(query))
+				if rec.Code != http.StatusPermanentRedirect {
+					t.Fatalf("expected the current variant to be served, got %d", rec.Code)
+				}
+				waitFor(t, func() bool {
+					source, err := ReadSourceInfo(fs, key)
+					return err == nil && source.Checked.After(old.Checked)
+				})
+			}
+			waitFor(t, func() bool { return len(pb.PublishedOn(ResizeTopic)) >= c.Published })
+			if n := len(pb.PublishedOn(ResizeTopic)); n != c.Published {
+				t.Fatalf("expected %d resize messages, got %d", c.Published, n)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if hits != 1 {
+				t.Errorf("expected the origin to be asked once, got %d", hits)
+			}
+			for _, m := range pb.PublishedOn(ResizeTopic) {
+				var opts ResizeOptions
+				if err := json.Unmarshal(m.Data, &opts); err != nil {
+					t.Fatal(err)
+				}
+				if !opts.RecordSource {
+					t.Errorf("expected resizes to record the source while revalidating, got %+v", opts)
+				}
+			}
+		})
+	}
+}
+
+func TestServeHTTP_ProxyStreamsObject(t *testing.T) {
+	s, fs, pb := newTestServer()
+	s.Serve = ServeProxy
+	query := url.Values{"url": {testOrigin}, "width": {"100"}, "encoding": {"webp"}}
+	key := testObjectKey(t, query)
+	created := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	fs.Put(key, []byte("resized"), "max-age=3600", created)
+	fs.SetContentType(key, "image/webp")
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, testRequest(query))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if body := rec.Body.String(); body != "resized" {
+		t.Fatalf("expected the stored object, got %q", body)
+	}
+	h := rec.Header()
+	if h.Get("Content-Type") != "image/webp" || h.Get("Content-Length") != "7" || h.Get("Cache-Control") != "max-age=3600" {
+		t.Errorf("unexpected headers %v", h)
+	}
+	if h.Get("Last-Modified") != created.Format(http.TimeFormat) || h.Get("ETag") == "" {
+		t.Errorf("unexpected validators %v", h)
+	}
+	if h.Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("expected nosniff, got %v", h)
+	}
+	if n := len(pb.Published()); n != 0 {
+		t.Fatalf("expected no resize messages, got %d", n)
+	}
+
+	req := testRequest(query)
+	req.Header.Set("If-None-Match", h.Get("ETag"))
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("expected 304, got %d", rec.Code)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("expected no body, got %q", rec.Body.String())
+	}
+}
+
+func TestServeHTTP_ProxyStreamsOriginOnMiss(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("ETag", `"origin"`)
+		w.Write([]byte("original"))
+	}))
+	defer origin.Close()
+
+	s, _, pb := newTestServer()
+	s.Serve = ServeProxy
+	s.Fetcher = &Fetcher{AllowPrivate: true}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, testRequest(url.Values{"url": {origin.URL + "/cover.png"}, "width": {"100"}}))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if body := rec.Body.String(); body != "original" {
+		t.Fatalf("expected the original, got %q", body)
+	}
+	h := rec.Header()
+	if h.Get("Content-Type") != "image/png" || h.Get("ETag") != `"origin"` || h.Get("Cache-Control") != "no-store" {
+		t.Errorf("unexpected headers %v", h)
+	}
+	if h.Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("expected nosniff, got %v", h)
+	}
+	if n := len(pb.PublishedOn(ResizeTopic)); n != 1 {
+		t.Fatalf("expected 1 resize message, got %d", n)
+	}
+}
+
+func TestServeHTTP_ProxyRedirectsToNonImageOrigin(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Status      int
+		ContentType string
+	}{
+		{"html", http.StatusOK, "text/html; charset=utf-8"},
+		{"svg", http.StatusOK, "image/svg+xml"},
+		{"missing type", http.StatusOK, ""},
+		{"not found", http.StatusNotFound, "image/png"},
+		{"server error", http.StatusInternalServerError, "image/png"},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header()["Content-Type"] = []string{c.ContentType}
+				w.WriteHeader(c.Status)
+				w.Write([]byte("<script>alert(1)</script>"))
+			}))
+			defer origin.Close()
+
+			s, _, _ := newTestServer()
+			s.Serve = ServeProxy
+			s.Fetcher = &Fetcher{AllowPrivate: true}
+
+			location := origin.URL + "/cover.png"
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, testRequest(url.Values{"url": {location}, "width": {"100"}}))
+
+			if rec.Code != http.StatusTemporaryRedirect {
+				t.Fatalf("expected 307, got %d", rec.Code)
+			}
+			if loc := rec.Header().Get("Location"); loc != location {
+				t.Fatalf("expected a redirect to the origin, got %q", loc)
+			}
+			if strings.Contains(rec.Body.String(), "<script>") {
+				t.Fatalf("expected the origin body not to be streamed, got %q", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestServeHTTP_ProxyRefusesPrivateOrigin(t *testing.T) {
+	s, _, _ := newTestServer()
+	s.Serve = ServeProxy
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, testRequest(url.Values{"url": {"http://127.0.0.1/cover.png"}, "width": {"100"}}))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+}
+
+// newPNGOrigin serves a 32x16 PNG after delay.
+func newPNGOrigin(t *testing.T, delay time.Duration) *httptest.Server {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 32, 16))); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(buf.Bytes())
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestServeHTTP_Sync(t *testing.T) {
+	if err := RegisterPreset("delivery-sync-test", Preset{"width": "16", "encoding": "png", "sync": "true"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		Name  string
+		Query url.Values
+		Delay time.Duration
+		Hit   bool
+	}{
+		{"within deadline", url.Values{"width": {"16"}, "encoding": {"png"}, "sync": {"1"}}, 0, true},
+		{"from preset", url.Values{"preset": {"delivery-sync-test"}}, 0, true},
+		{"deadline passed", url.Values{"width": {"16"}, "encoding": {"png"}, "sync": {"1"}}, 200 * time.Millisecond, false},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			origin := newPNGOrigin(t, c.Delay)
+			s, fs, pb := newTestServer()
+			s.Fetcher = &Fetcher{AllowPrivate: true}
+			s.SyncTimeout = 50 * time.Millisecond
+			c.Query.Set("url", origin.URL+"/cover.png")
+			key := testObjectKey(t, c.Query)
+
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, testRequest(c.Query))
+
+			if !c.Hit {
+				if rec.Code != http.StatusTemporaryRedirect {
+					t.Fatalf("expected 307, got %d", rec.Code)
+				}
+				// The inline resize carries on, so it is not published too.
+				if n := len(pb.Published()); n != 0 {
+					t.Fatalf("expected no resize messages, got %d", n)
+				}
+				waitFor(t, func() bool {
+					_, ok := fs.Get(key)
+					return ok
+				})
+				return
+			}
+			if rec.Code != http.StatusPermanentRedirect {
+				t.Fatalf("expected 308, got %d", rec.Code)
+			}
+			if loc := rec.Header().Get("Location"); loc != fs.ObjectURL(key) {
+				t.Fatalf("expected redirect to %q, got %q", fs.ObjectURL(key), loc)
+			}
+			if _, ok := fs.Get(key); !ok {
+				t.Fatalf("expected %s to be written, have %v", key, fs.Names())
+			}
+			if n := len(pb.Published()); n != 0 {
+				t.Fatalf("expected no resize messages, got %d", n)
+			}
+		})
+	}
+}
+
+func TestServeHTTP_UncacheableOriginServesVariant(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 32, 16))); err != nil {
+		t.Fatal(err)
+	}
+	for _, cc := range []string{"no-cache", "no-store", "max-age=0"} {
+		t.Run(cc, func(t *testing.T) {
+			origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/png")
+				w.Header().Set("Cache-Control", cc)
+				w.Write(buf.Bytes())
+			}))
+			defer origin.Close()
+			s, fs, pb := newTestServer()
+			s.Serve = ServeProxy
+			s.Fetcher = &Fetcher{AllowPrivate: true}
+			query := url.Values{"url": {origin.URL + "/cover.png"}, "width": {"16"}, "encoding": {"png"}}
+			key := testObjectKey(t, query)
+
+			query.Set("sync", "1")
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, testRequest(query))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected the variant to be resized inline, got %d", rec.Code)
+			}
+
+			// Each request serves the variant, while refreshes are
+			// coalesced by the pending claim.
+			query.Del("sync")
+			for i := 0; i < 3; i++ {
+				rec = httptest.NewRecorder()
+				s.ServeHTTP(rec, testRequest(query))
+				if rec.Code != http.StatusOK {
+					t.Fatalf("expected the variant to be served, got %d", rec.Code)
+				}
+				if got := rec.Header().Get("Cache-Control"); got != cc {
+					t.Errorf("expected the origin's %q to be passed on, got %q", cc, got)
+				}
+			}
+			if n := len(pb.PublishedOn(ResizeTopic)); n != 1 {
+				t.Fatalf("expected one refresh to be published, got %d", n)
+			}
+			if f, _ := fs.Get(key); f.Control != cc {
+				t.Errorf("expected the origin's %q to be stored, got %q", cc, f.Control)
+			}
+		})
+	}
+}
+
+// waitFor polls cond until it holds or a second has passed.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestServeHTTP_SyncRunsOncePerVariant(t *testing.T) {
+	var mu sync.Mutex
+	hits := 0
+	slow := newPNGOrigin(t, 100*time.Millisecond)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits++
+		mu.Unlock()
+		slow.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer origin.Close()
+
+	s, fs, pb := newTestServer()
+	s.Fetcher = &Fetcher{AllowPrivate: true}
+	s.SyncTimeout = 10 * time.Millisecond
+	query := url.Values{"url": {origin.URL + "/cover.png"}, "width": {"16"}, "sync": {"1"}}
+	key := testObjectKey(t, query)
+
+	for i := 0; i < 5; i++ {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, testRequest(query))
+		if rec.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("expected 307, got %d", rec.Code)
+		}
+	}
+	waitFor(t, func() bool {
+		_, ok := fs.Get(key)
+		return ok
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if hits != 1 {
+		t.Fatalf("expected 1 inline resize, got %d", hits)
+	}
+	if n := len(pb.Published()); n != 0 {
+		t.Fatalf("expected no resize messages, got %d", n)
+	}
+}
+
+func TestServeHTTP_SyncConcurrencyPublishesOverflow(t *testing.T) {
+	origin := newPNGOrigin(t, 100*time.Millisecond)
+	s, _, pb := newTestServer()
+	s.Fetcher = &Fetcher{AllowPrivate: true}
+	s.SyncTimeout = 10 * time.Millisecond
+	s.SyncConcurrency = 1
+
+	for _, width := range []string{"16", "17"} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, testRequest(url.Values{"url": {origin.URL + "/cover.png"}, "width": {width}, "sync": {"1"}}))
+		if rec.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("expected 307, got %d", rec.Code)
+		}
+	}
+	// The first holds the only slot, so the second is published.
+	if n := len(pb.PublishedOn(ResizeTopic)); n != 1 {
+		t.Fatalf("expected 1 resize message, got %d", n)
+	}
+}
+
+func TestServeHTTP_SyncRecordsFailure(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not an image"))
+	}))
+	defer origin.Close()
+
+	s, fs, pb := newTestServer()
+	s.Fetcher = &Fetcher{AllowPrivate: true}
+	query := url.Values{"url": {origin.URL + "/cover.png"}, "width": {"16"}, "sync": {"1"}}
+	key := testObjectKey(t, query)
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, testRequest(query))
+		if rec.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("expected 307, got %d", rec.Code)
+		}
+	}
+	f, err := ReadFailure(fs, key)
+	if err != nil || f == nil {
+		t.Fatalf("expected a failure marker, got %v, %v", f, err)
+	}
+	if n := len(pb.Published()); n != 0 {
+		t.Fatalf("expected no resize messages, got %d", n)
+	}
+}
+
+func TestServeHTTP_SyncHonoursLeaseTTL(t *testing.T) {
+	cases := []struct {
+		Name     string
+		LeaseTTL time.Duration
+		Resized  bool
+	}{
+		{"default lease expired", 0, true},
+		{"configured lease held", 10 * time.Minute, false},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			origin := newPNGOrigin(t, 0)
+			s, fs, _ := newTestServer()
+			s.Fetcher = &Fetcher{AllowPrivate: true}
+			s.LeaseTTL = c.LeaseTTL
+			query := url.Values{"url": {origin.URL + "/cover.png"}, "width": {"16"}, "sync": {"1"}}
+			key := testObjectKey(t, query)
+
+			// Another worker took the lease longer ago than DefaultLeaseTTL.
+			taken := time.Now()
+			fs.Now = func() time.Time { return taken }
+			if _, err := fs.Lease(key, DefaultLeaseTTL); err != nil {
+				t.Fatal(err)
+			}
+			fs.Now = func() time.Time { return taken.Add(DefaultLeaseTTL + time.Minute) }
+
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, testRequest(query))
+			if resized := rec.Code == http.StatusPermanentRedirect; resized != c.Resized {
+				t.Fatalf("expected resized %v, got %d", c.Resized, rec.Code)
+			}
+		})
+	}
+}
+
+func TestServeHTTP_SyncProxyStreamsResult(t *testing.T) {
+	origin := newPNGOrigin(t, 0)
+	s, _, _ := newTestServer()
+	s.Serve = ServeProxy
+	s.Fetcher = &Fetcher{AllowPrivate: true}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, testRequest(url.Values{"url": {origin.URL + "/cover.png"}, "width": {"16"}, "sync": {""}}))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "image/png" {
+		t.Fatalf("expected image/png, got %q", ct)
+	}
+	img, err := png.Decode(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 16 || b.Dy() != 8 {
+		t.Errorf("expected 16x8 image, got %dx%d", b.Dx(), b.Dy())
+	}
+}
+
+func TestParseServeMode(t *testing.T) {
+	for in, want := range map[string]ServeMode{"": ServeRedirect, "redirect": ServeRedirect, "Proxy": ServeProxy} {
+		if got, err := ParseServeMode(in); err != nil || got != want {
+			t.Errorf("ParseServeMode(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseServeMode("stream"); err == nil {
+		t.Error("expected an unknown mode to fail")
+	}
+}
+
+func TestHostPermitted_EmptyAllowFlag(t *testing.T) {
+	s := &Server{PermittedHosts: strings.Split("", ",")}
+	if s.HostPermitted("cdn.monstercat.com") {
+		t.Error("An empty -allow flag should permit no host.")
+	}
+	s.PermittedHosts = nil
+	if !s.HostPermitted("cdn.monstercat.com") {
+		t.Error("A nil allow list should permit any host.")
+	}
+}
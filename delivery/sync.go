@@ -0,0 +1,135 @@
+package delivery
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/monstercat/golib/logger"
+
+	. "github.com/monstercat/asset-delivery"
+)
+
+// DefaultSyncTimeout is how long a `sync` request waits for its resize.
+const DefaultSyncTimeout = 3 * time.Second
+
+// DefaultSyncConcurrency is how many inline resizes may run at once.
+const DefaultSyncConcurrency = 2
+
+func (s *Server) syncTimeout() time.Duration {
+	if s.SyncTimeout > 0 {
+		return s.SyncTimeout
+	}
+	return DefaultSyncTimeout
+}
+
+func (s *Server) failureTTL() time.Duration {
+	if s.FailureTTL > 0 {
+		return s.FailureTTL
+	}
+	return DefaultFailureTTL
+}
+
+func (s *Server) leaseTTL() time.Duration {
+	if s.LeaseTTL > 0 {
+		return s.LeaseTTL
+	}
+	return DefaultLeaseTTL
+}
+
+func (s *Server) syncSlots() chan struct{} {
+	s.syncOnce.Do(func() {
+		n := s.SyncConcurrency
+		if n <= 0 {
+			n = DefaultSyncConcurrency
+		}
+		s.slots = make(chan struct{}, n)
+	})
+	return s.slots
+}
+
+// resizeSync resizes opts inline and reports whether the result was
+// written within the deadline.
+//
+// The inline resize holds the variant's pending claim, so concurrent
+// requests for it neither resize it again nor publish it, and the worker
+// lease when FS is a Leaser. When every slot is taken, or the variant is
+// already pending, nothing is run and the caller falls back to publishing,
+// which the claim dedupes. A resize that runs over keeps going in the
+// background and holds the claim until it is done, but the caller should
+// not rely on it; on Cloud Run, work after the response is throttled.
+func (s *Server) resizeSync(opts ResizeOptions, l logger.Logger) bool {
+	slots := s.syncSlots()
+	select {
+	case slots <- struct{}{}:
+	default:
+		l.Log(logger.SeverityInfo, "No slot for an inline resize.")
+		return false
+	}
+	key := opts.ObjectKey()
+	if !s.pending.claim(key, time.Now(), s.pendingTTL()) {
+		<-slots
+		l.Log(logger.SeverityInfo, "Resize already pending for "+key)
+		return false
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() { <-slots }()
+		err := s.resizeInline(opts, l)
+		// The claim is kept while a worker holds the lease, and after a
+		// failure a retry would repeat, so the variant is not published
+		// again.
+		if err == nil || err != ErrLeaseHeld && ErrorStatus(err) >= http.StatusInternalServerError {
+			s.pending.release(key)
+		}
+		done <- err
+	}()
+
+	timer := time.NewTimer(s.syncTimeout())
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err == nil
+	case <-timer.C:
+		l.Log(logger.SeverityWarning, fmt.Sprintf("Inline resize did not finish within %s.", s.syncTimeout()))
+		return false
+	}
+}
+
+// resizeInline runs the resize as the worker does: under the variant's
+// lease, recording a failure marker for errors a retry would repeat.
+func (s *Server) resizeInline(opts ResizeOptions, l logger.Logger) error {
+	key := opts.ObjectKey()
+	if leaser, ok := s.FS.(Leaser); ok {
+		release, err := leaser.Lease(key, s.leaseTTL())
+		if err == ErrLeaseHeld {
+			l.Log(logger.SeverityInfo, "Another worker is resizing "+key)
+			return err
+		}
+		if err != nil {
+			l.Log(logger.SeverityError, "Could not take resize lease: "+err.Error())
+			return &SystemError{Detail: "Could not take resize lease.", RootError: err}
+		}
+		defer func() {
+			if err := release(); err != nil && err != ErrNoFile {
+				l.Log(logger.SeverityWarning, "Could not release resize lease: "+err.Error())
+			}
+		}()
+	}
+
+	if err := ResizeWithFetcher(s.FS, s.fetcher(), opts); err != nil {
+		if v, ok := err.(RootError); ok && v.Root() != nil {
+			l.Log(logger.SeverityWarning, "Inline resize failed. "+err.Error()+"; "+v.Root().Error())
+		} else {
+			l.Log(logger.SeverityWarning, "Inline resize failed. "+err.Error())
+		}
+		if ErrorStatus(err) < http.StatusInternalServerError {
+			if ferr := WriteFailure(s.FS, key, NewFailure(err, time.Now(), s.failureTTL())); ferr != nil {
+				l.Log(logger.SeverityWarning, "Could not write failure marker: "+ferr.Error())
+			}
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package asset_delivery
+
+import (
+	"image/png"
+	"strconv"
+	"strings"
+)
+
+// DefaultQuality is the JPEG and lossy WebP quality used when a request
+// does not ask for one.
+const DefaultQuality = 80
+
+// Compression is the PNG compression level.
+type Compression string
+
+const (
+	CompressionDefault Compression = "default"
+	CompressionNone    Compression = "none"
+	CompressionFast    Compression = "fast"
+	CompressionBest    Compression = "best"
+)
+
+var pngCompressionLevels = map[Compression]png.CompressionLevel{
+	"":                 png.DefaultCompression,
+	CompressionDefault: png.DefaultCompression,
+	CompressionNone:    png.NoCompression,
+	CompressionFast:    png.BestSpeed,
+	CompressionBest:    png.BestCompression,
+}
+
+func (c Compression) Valid() bool {
+	_, ok := pngCompressionLevels[c]
+	return ok
+}
+
+// EncodeOptions configures the encoder that writes the resized image.
+// Options that do not apply to the output format are ignored.
+type EncodeOptions struct {
+	// Quality is the JPEG and lossy WebP quality, 1-100. Zero means
+	// DefaultQuality.
+	Quality int
+	// Lossless selects lossless WebP encoding.
+	Lossless bool
+	// Progressive selects progressive JPEG encoding; see progressiveJPEG.
+	Progressive bool
+	// Compression is the PNG compression level.
+	Compression Compression
+	// KeepMetadata copies the source's Artist and Copyright EXIF fields to
+	// the output. Otherwise, and for every other field, metadata is
+	// stripped.
+	KeepMetadata bool
+}
+
+func (o EncodeOptions) quality() int {
+	if o.Quality <= 0 {
+		return DefaultQuality
+	}
+	return o.Quality
+}
+
+// variant describes the options for ResizeOptions.variant. Defaults are
+// left out so that, for instance, quality=80 shares storage with requests
+// that do not set a quality.
+func (o EncodeOptions) variant() string {
+	var b strings.Builder
+	if q := o.quality(); q != DefaultQuality {
+		b.WriteString("-q" + strconv.Itoa(q))
+	}
+	if o.Lossless {
+		b.WriteString("-lossless")
+	}
+	if o.Progressive {
+		b.WriteString("-progressive")
+	}
+	if o.Compression != "" && o.Compression != CompressionDefault {
+		b.WriteString("-c" + string(o.Compression))
+	}
+	if o.KeepMetadata {
+		b.WriteString("-meta")
+	}
+	return b.String()
+}
+
+// parseEncodeOptions reads the encoder query parameters into o.
+func parseEncodeOptions(m map[string][]string, o *EncodeOptions) error {
+	if xs, ok := m["quality"]; ok {
+		q, err := strconv.Atoi(strings.TrimSpace(xs[0]))
+		if err != nil || q < 1 || q > 100 {
+			return &ParamError{Param: "quality", Detail: "Expected a quality between 1 and 100."}
+		}
+		o.Quality = q
+	}
+	if xs, ok := m["lossless"]; ok {
+		v, err := parseFlag(xs[0])
+		if err != nil {
+			return &ParamError{Param: "lossless", Detail: "Expected true or false."}
+		}
+		o.Lossless = v
+	}
+	if xs, ok := m["progressive"]; ok {
+		v, err := parseFlag(xs[0])
+		if err != nil {
+			return &ParamError{Param: "progressive", Detail: "Expected true or false."}
+		}
+		o.Progressive = v
+	}
+	if xs, ok := m["compression"]; ok {
+		o.Compression = Compression(strings.ToLower(strings.TrimSpace(xs[0])))
+		if !o.Compression.Valid() {
+			return &ParamError{Param: "compression", Detail: "Expected one of default, none, fast or best."}
+		}
+	}
+	if xs, ok := m["keep-metadata"]; ok {
+		v, err := parseFlag(xs[0])
+		if err != nil {
+			return &ParamError{Param: "keep-metadata", Detail: "Expected true or false."}
+		}
+		o.KeepMetadata = v
+	}
+	return nil
+}
+
+// parseFlag parses a boolean query value. A bare parameter (e.g.
+// "&lossless") counts as true.
+func parseFlag(str string) (bool, error) {
+	str = strings.TrimSpace(str)
+	if str == "" {
+		return true, nil
+	}
+	return strconv.ParseBool(str)
+}
@@ -56,12 +56,67 @@ func (err *ParamError) Root() error {
 	return err.RootError
 }
 
-func WriteError(w http.ResponseWriter, err error) {
-	status := http.StatusInternalServerError
+// SourceTooLargeError is returned when a source image is larger than
+// MaxSourceBytes. Size is the Content-Length, or the bytes read before the
+// limit was hit.
+type SourceTooLargeError struct {
+	Size  int64
+	Limit int64
+}
+
+func (err *SourceTooLargeError) Status() int {
+	return http.StatusRequestEntityTooLarge
+}
+
+func (err *SourceTooLargeError) Error() string {
+	return fmt.Sprintf("Source image is larger than %d bytes.", err.Limit)
+}
+
+// SourcePixelsError is returned when a source image has more than
+// MaxSourcePixels pixels.
+type SourcePixelsError struct {
+	Width  int
+	Height int
+	Limit  int64
+}
+
+func (err *SourcePixelsError) Status() int {
+	return http.StatusUnprocessableEntity
+}
+
+func (err *SourcePixelsError) Error() string {
+	return fmt.Sprintf("Source image is %dx%d, more than %d pixels.", err.Width, err.Height, err.Limit)
+}
+
+// SignatureError is returned for delivery requests that are unsigned, or
+// whose signature is invalid or expired.
+type SignatureError struct {
+	RootError error
+}
+
+func (err *SignatureError) Status() int {
+	return http.StatusForbidden
+}
+
+func (err *SignatureError) Error() string {
+	return "Request signature is missing, invalid or expired."
+}
+
+func (err *SignatureError) Root() error {
+	return err.RootError
+}
+
+// ErrorStatus returns the HTTP status carried by err, or 500 when it has
+// none.
+func ErrorStatus(err error) int {
 	if v, ok := err.(HTTPError); ok {
-		status = v.Status()
+		return v.Status()
 	}
-	w.WriteHeader(status)
+	return http.StatusInternalServerError
+}
+
+func WriteError(w http.ResponseWriter, err error) {
+	w.WriteHeader(ErrorStatus(err))
 	w.Write([]byte(err.Error()))
 
 	if v, ok := err.(RootError); ok && v.Root() != nil {
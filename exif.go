@@ -0,0 +1,264 @@
+package asset_delivery
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+
+	"github.com/disintegration/imaging"
+)
+
+var ErrInvalidEXIF = errors.New("invalid exif data")
+
+// exifHeader prefixes the TIFF structure in a JPEG APP1 segment, and
+// sometimes in WebP EXIF chunks.
+var exifHeader = []byte("Exif\x00\x00")
+
+const (
+	tagOrientation = 0x0112
+	tagArtist      = 0x013b
+	tagCopyright   = 0x8298
+
+	tiffASCII = 2
+	tiffShort = 3
+)
+
+// Metadata holds the EXIF fields the resize pipeline cares about. Anything
+// else in the source, GPS and XMP included, is dropped.
+type Metadata struct {
+	// Orientation is the EXIF orientation, 1-8. Zero means unknown.
+	Orientation int
+	Artist      string
+	Copyright   string
+}
+
+// ParseEXIF reads Metadata from IFD0 of an EXIF block, with or without the
+// "Exif\0\0" header.
+func ParseEXIF(b []byte) (Metadata, error) {
+	var m Metadata
+	b = bytes.TrimPrefix(b, exifHeader)
+	if len(b) < 8 {
+		return m, ErrInvalidEXIF
+	}
+	var bo binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return m, ErrInvalidEXIF
+	}
+	if bo.Uint16(b[2:]) != 42 {
+		return m, ErrInvalidEXIF
+	}
+	ifd := int(bo.Uint32(b[4:]))
+	if ifd < 8 || ifd+2 > len(b) {
+		return m, ErrInvalidEXIF
+	}
+	n := int(bo.Uint16(b[ifd:]))
+	for i := 0; i < n; i++ {
+		e := ifd + 2 + i*12
+		if e+12 > len(b) {
+			break
+		}
+		tag, typ, count := bo.Uint16(b[e:]), bo.Uint16(b[e+2:]), int(bo.Uint32(b[e+4:]))
+		switch tag {
+		case tagOrientation:
+			if typ == tiffShort && count >= 1 {
+				m.Orientation = int(bo.Uint16(b[e+8:]))
+			}
+		case tagArtist, tagCopyright:
+			if typ != tiffASCII {
+				continue
+			}
+			val := b[e+8 : e+12]
+			if count > 4 {
+				off := int(bo.Uint32(b[e+8:]))
+				if off < 0 || count > len(b)-off {
+					return m, ErrInvalidEXIF
+				}
+				val = b[off : off+count]
+			} else {
+				val = val[:count]
+			}
+			s := string(bytes.TrimRight(val, "\x00"))
+			if tag == tagArtist {
+				m.Artist = s
+			} else {
+				m.Copyright = s
+			}
+		}
+	}
+	return m, nil
+}
+
+// EXIF encodes the non-empty fields of m as a little-endian TIFF
+// structure, without the "Exif\0\0" header. It returns nil when there is
+// nothing to write.
+func (m Metadata) EXIF() []byte {
+	type entry struct {
+		tag, typ uint16
+		count    uint32
+		value    []byte
+	}
+	var entries []entry
+	if m.Orientation > 0 {
+		entries = append(entries, entry{tagOrientation, tiffShort, 1, binary.LittleEndian.AppendUint16(nil, uint16(m.Orientation))})
+	}
+	if m.Artist != "" {
+		entries = append(entries, entry{tagArtist, tiffASCII, uint32(len(m.Artist) + 1), []byte(m.Artist + "\x00")})
+	}
+	if m.Copyright != "" {
+		entries = append(entries, entry{tagCopyright, tiffASCII, uint32(len(m.Copyright) + 1), []byte(m.Copyright + "\x00")})
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	bo := binary.LittleEndian
+	b := []byte("II")
+	b = bo.AppendUint16(b, 42)
+	b = bo.AppendUint32(b, 8)
+	b = bo.AppendUint16(b, uint16(len(entries)))
+	data := 8 + 2 + len(entries)*12 + 4
+	var values []byte
+	for _, e := range entries {
+		b = bo.AppendUint16(b, e.tag)
+		b = bo.AppendUint16(b, e.typ)
+		b = bo.AppendUint32(b, e.count)
+		if len(e.value) <= 4 {
+			var inline [4]byte
+			copy(inline[:], e.value)
+			b = append(b, inline[:]...)
+			continue
+		}
+		b = bo.AppendUint32(b, uint32(data+len(values)))
+		values = append(values, e.value...)
+		if len(values)%2 == 1 {
+			values = append(values, 0)
+		}
+	}
+	b = bo.AppendUint32(b, 0)
+	return append(b, values...)
+}
+
+// Orient transforms img so that it displays upright given its EXIF
+// orientation.
+func Orient(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
+
+// readMetadata returns the EXIF metadata of the encoded image data.
+// Missing or malformed metadata is not an error; the image is used as is.
+func readMetadata(data []byte, format string) Metadata {
+	c, ok := CodecByName(format)
+	if !ok || c.ReadEXIF == nil {
+		return Metadata{}
+	}
+	raw := c.ReadEXIF(data)
+	if raw == nil {
+		return Metadata{}
+	}
+	m, _ := ParseEXIF(raw)
+	return m
+}
+
+// jpegEXIF returns the EXIF block of the first APP1 Exif segment.
+func jpegEXIF(data []byte) []byte {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return nil
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xff:
+			i++
+			continue
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd8):
+			i += 2
+			continue
+		case marker == 0xda || marker == 0xd9:
+			return nil
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) {
+			return nil
+		}
+		if seg := data[i+4 : end]; marker == 0xe1 && bytes.HasPrefix(seg, exifHeader) {
+			return seg[len(exifHeader):]
+		}
+		i = end
+	}
+	return nil
+}
+
+// jpegWithEXIF inserts an APP1 Exif segment directly after the SOI marker.
+func jpegWithEXIF(data, exif []byte) ([]byte, error) {
+	n := 2 + len(exifHeader) + len(exif)
+	if len(data) < 2 || n > 0xffff {
+		return nil, ErrInvalidEXIF
+	}
+	out := make([]byte, 0, len(data)+2+n)
+	out = append(out, data[:2]...)
+	out = append(out, 0xff, 0xe1)
+	out = binary.BigEndian.AppendUint16(out, uint16(n))
+	out = append(out, exifHeader...)
+	out = append(out, exif...)
+	return append(out, data[2:]...), nil
+}
+
+// pngEXIF returns the contents of the eXIf chunk.
+func pngEXIF(data []byte) []byte {
+	for i := 8; i+8 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		typ := string(data[i+4 : i+8])
+		if n < 0 || i+12+n > len(data) || typ == "IDAT" {
+			return nil
+		}
+		if typ == "eXIf" {
+			return data[i+8 : i+8+n]
+		}
+		i += 12 + n
+	}
+	return nil
+}
+
+// pngWithEXIF inserts an eXIf chunk after IHDR, which must be the first
+// chunk.
+func pngWithEXIF(data, exif []byte) ([]byte, error) {
+	const ihdrEnd = 8 + 12 + 13
+	if len(data) < ihdrEnd || string(data[12:16]) != "IHDR" {
+		return nil, ErrInvalidEXIF
+	}
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(exif)))
+	chunk = append(chunk, "eXIf"...)
+	chunk = append(chunk, exif...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	out := make([]byte, 0, len(data)+len(chunk))
+	out = append(out, data[:ihdrEnd]...)
+	out = append(out, chunk...)
+	return append(out, data[ihdrEnd:]...), nil
+}
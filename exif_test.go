@@ -0,0 +1,173 @@
+package asset_delivery
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/chai2010/webp"
+)
+
+func TestParseEXIF(t *testing.T) {
+	want := Metadata{Orientation: 6, Artist: "Ana", Copyright: "(c) 2026 Monstercat"}
+	got, err := ParseEXIF(want.EXIF())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+
+	got, err = ParseEXIF(append(append([]byte{}, exifHeader...), want.EXIF()...))
+	if err != nil || got != want {
+		t.Fatalf("expected the Exif header to be skipped, got %+v, %v", got, err)
+	}
+
+	for _, b := range [][]byte{nil, []byte("Exif\x00\x00"), []byte("XX*\x00\x08\x00\x00\x00"), []byte("II*\x00\xff\x00\x00\x00")} {
+		if _, err := ParseEXIF(b); err != ErrInvalidEXIF {
+			t.Errorf("expected ErrInvalidEXIF for %q, got %v", b, err)
+		}
+	}
+}
+
+func TestOrient(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.White)
+	img.Set(1, 0, color.Black)
+	cases := []struct {
+		Orientation int
+		Size        image.Point
+		White       image.Point
+	}{
+		{0, image.Pt(2, 1), image.Pt(0, 0)},
+		{1, image.Pt(2, 1), image.Pt(0, 0)},
+		{2, image.Pt(2, 1), image.Pt(1, 0)},
+		{3, image.Pt(2, 1), image.Pt(1, 0)},
+		{6, image.Pt(1, 2), image.Pt(0, 0)},
+		{8, image.Pt(1, 2), image.Pt(0, 1)},
+	}
+	for _, c := range cases {
+		got := Orient(img, c.Orientation)
+		if got.Bounds().Size() != c.Size {
+			t.Errorf("orientation %d: expected size %v, got %v", c.Orientation, c.Size, got.Bounds().Size())
+			continue
+		}
+		if r, _, _, _ := got.At(c.White.X, c.White.Y).RGBA(); r != 0xffff {
+			t.Errorf("orientation %d: expected white at %v", c.Orientation, c.White)
+		}
+	}
+}
+
+// orientedJPEG returns a 40x20 JPEG, red on the left and blue on the
+// right, tagged with orientation 6 and copyright fields.
+func orientedJPEG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			if x < 20 {
+				img.Set(x, y, color.NRGBA{R: 255, A: 255})
+			} else {
+				img.Set(x, y, color.NRGBA{B: 255, A: 255})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := jpegWithEXIF(buf.Bytes(), Metadata{Orientation: 6, Artist: "Ana", Copyright: "Monstercat"}.EXIF())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestResizeBytes_AutoOrients(t *testing.T) {
+	bits, err := resizeBytes(orientedJPEG(t), ResizeOptions{Location: "https://a/b.jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bits.Bytes()
+	if exif := jpegEXIF(data); exif != nil {
+		t.Fatalf("expected metadata to be stripped, got %q", exif)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := img.Bounds().Size(); s != image.Pt(20, 40) {
+		t.Fatalf("expected 20x40, got %v", s)
+	}
+	if r, _, b, _ := img.At(10, 5).RGBA(); r < b {
+		t.Fatalf("expected red at the top, got %v", img.At(10, 5))
+	}
+	if r, _, b, _ := img.At(10, 35).RGBA(); b < r {
+		t.Fatalf("expected blue at the bottom, got %v", img.At(10, 35))
+	}
+}
+
+func TestResizeBytes_KeepMetadata(t *testing.T) {
+	cases := []struct {
+		Encoding string
+		Read     func([]byte) []byte
+		Decode   func([]byte) (image.Image, error)
+	}{
+		{"jpeg", jpegEXIF, func(b []byte) (image.Image, error) { return jpeg.Decode(bytes.NewReader(b)) }},
+		{"png", pngEXIF, func(b []byte) (image.Image, error) { return png.Decode(bytes.NewReader(b)) }},
+		{"webp", func(b []byte) []byte {
+			exif, _ := webp.GetMetadata(b, "EXIF")
+			return exif
+		}, func(b []byte) (image.Image, error) { return webp.Decode(bytes.NewReader(b)) }},
+	}
+	for _, c := range cases {
+		t.Run(c.Encoding, func(t *testing.T) {
+			opts := ResizeOptions{Width: 10, Location: "https://a/b.jpg", Encoding: c.Encoding, EncodeOptions: EncodeOptions{KeepMetadata: true}}
+			bits, err := resizeBytes(orientedJPEG(t), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := bits.Bytes()
+			meta, err := ParseEXIF(c.Read(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := Metadata{Artist: "Ana", Copyright: "Monstercat"}
+			if meta != want {
+				t.Fatalf("expected %+v, got %+v", want, meta)
+			}
+			img, err := c.Decode(data)
+			if err != nil {
+				t.Fatalf("expected a valid image, got %v", err)
+			}
+			if s := img.Bounds().Size(); s != image.Pt(10, 20) {
+				t.Fatalf("expected 10x20, got %v", s)
+			}
+		})
+	}
+}
+
+func TestResizeBytes_AutoOrientsWebP(t *testing.T) {
+	src, err := webp.EncodeRGBA(image.NewRGBA(image.Rect(0, 0, 40, 20)), 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err = webp.SetMetadata(src, Metadata{Orientation: 8}.EXIF(), "EXIF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bits, err := resizeBytes(src, ResizeOptions{Location: "https://a/b.webp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := webp.Decode(bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := img.Bounds().Size(); s != image.Pt(20, 40) {
+		t.Fatalf("expected 20x40, got %v", s)
+	}
+}
@@ -0,0 +1,81 @@
+package asset_delivery
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// DefaultFailureTTL is how long a failure marker stops a variant from
+// being resized again.
+const DefaultFailureTTL = time.Hour
+
+// failureSuffix is appended to an object key to name its failure marker.
+const failureSuffix = ".failure"
+
+// Failure records why a variant could not be resized, so the delivery
+// server can stop publishing it until RetryAfter.
+type Failure struct {
+	// Reason is the text of Status. Markers are stored next to the
+	// variant, in a bucket that may be public, so the error itself, which
+	// can name origins and internal hosts, is only logged.
+	Reason     string    `json:"reason"`
+	Status     int       `json:"status"`
+	At         time.Time `json:"at"`
+	RetryAfter time.Time `json:"retryAfter"`
+}
+
+// NewFailure describes err, a failed resize at now, retried after ttl.
+func NewFailure(err error, now time.Time, ttl time.Duration) *Failure {
+	status := ErrorStatus(err)
+	return &Failure{
+		Reason:     http.StatusText(status),
+		Status:     status,
+		At:         now.UTC(),
+		RetryAfter: now.Add(ttl).UTC(),
+	}
+}
+
+// Active reports whether the variant should not be retried at now.
+func (f *Failure) Active(now time.Time) bool {
+	return now.Before(f.RetryAfter)
+}
+
+// WriteFailure stores f as the failure marker of objectKey.
+func WriteFailure(fs FileSystem, objectKey string, f *Failure) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return fs.Write(objectKey+failureSuffix, bytes.NewReader(b), &WriteInfo{
+		cacheControl: "no-store",
+		contentType:  "application/json",
+	})
+}
+
+// ReadFailure returns the failure marker of objectKey, or nil when there
+// is none.
+func ReadFailure(fs FileSystem, objectKey string) (*Failure, error) {
+	r, err := fs.ReadCloser(objectKey + failureSuffix)
+	if err == ErrNoFile {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var f Failure
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// ClearFailure removes the failure marker of objectKey, if any.
+func ClearFailure(fs FileSystem, objectKey string) error {
+	if err := fs.Delete(objectKey + failureSuffix); err != nil && err != ErrNoFile {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package asset_delivery
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFailureRoundTrip(t *testing.T) {
+	fs := &LocalFileSystem{Root: t.TempDir(), Volume: "bucket"}
+	key := "resized/abc/100.webp"
+
+	if f, err := ReadFailure(fs, key); err != nil || f != nil {
+		t.Fatalf("expected no failure, got %+v, %v", f, err)
+	}
+
+	now := time.Now()
+	err := &ParamError{Param: "url", Detail: "Could not get image", RootError: ErrAddressBlocked}
+	if err := WriteFailure(fs, key, NewFailure(err, now, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	f, rerr := ReadFailure(fs, key)
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	if f.Status != http.StatusBadRequest || f.Reason != "Bad Request" {
+		t.Errorf("unexpected failure %+v", f)
+	}
+	if strings.Contains(f.Reason, ErrAddressBlocked.Error()) || strings.Contains(f.Reason, "Could not get image") {
+		t.Errorf("expected the error not to be stored, got %q", f.Reason)
+	}
+	if !f.Active(now.Add(59*time.Minute)) || f.Active(now.Add(time.Hour)) {
+		t.Errorf("expected the failure to be active for an hour from %s, got %+v", now, f)
+	}
+	if _, err := fs.Info(key); err != ErrNoFile {
+		t.Errorf("expected the marker not to look like the object, got %v", err)
+	}
+
+	if err := ClearFailure(fs, key); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := ReadFailure(fs, key); err != nil || f != nil {
+		t.Fatalf("expected the failure to be cleared, got %+v, %v", f, err)
+	}
+	if err := ClearFailure(fs, key); err != nil {
+		t.Errorf("expected clearing twice to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package asset_delivery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrAddressBlocked   = errors.New("address not allowed")
+	ErrSchemeNotAllowed = errors.New("scheme not allowed")
+	ErrHostNotPermitted = errors.New("host not permitted")
+	ErrTooManyRedirects = errors.New("too many redirects")
+)
+
+// OriginStatusError is returned when the origin answers a source download
+// with anything but a 2xx.
+type OriginStatusError struct {
+	StatusCode int
+}
+
+func (err *OriginStatusError) Error() string {
+	return fmt.Sprintf("origin responded %d", err.StatusCode)
+}
+
+// Transient reports whether asking again may get a different answer.
+func (err *OriginStatusError) Transient() bool {
+	return err.StatusCode >= 500 || err.StatusCode == http.StatusRequestTimeout || err.StatusCode == http.StatusTooManyRequests
+}
+
+// DefaultFetchTimeout bounds a whole source download, redirects included.
+const DefaultFetchTimeout = 5 * time.Second
+
+// DefaultMaxRedirects is the number of redirects a Fetcher follows.
+const DefaultMaxRedirects = 5
+
+// blockedPrefixes are the address ranges, beyond those the net/netip
+// predicates cover, that a Fetcher never connects to.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved, broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64, may reach IPv4 internals
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+	netip.MustParsePrefix("2002::/16"),      // 6to4
+	netip.MustParsePrefix("2001::/32"),      // Teredo
+}
+
+// AddressBlocked reports whether addr is loopback, private, link-local
+// (which includes the 169.254.169.254 metadata service), multicast,
+// unspecified or otherwise not a public unicast address.
+func AddressBlocked(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return true
+	}
+	for _, p := range blockedPrefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fetcher downloads source images without letting a request, or any
+// redirect it follows, reach internal addresses. Addresses are checked
+// when connecting, after DNS resolution, so a public name that resolves to
+// a private address is refused too. The zero value is ready to use.
+type Fetcher struct {
+	// PermittedHosts limits the hosts fetched, redirect targets included,
+	// using the same patterns as the delivery server's -allow flag. With
+	// no entries any host is permitted.
+	PermittedHosts []string
+	// AllowPrivate disables the address checks. It is meant for tests and
+	// trusted networks only.
+	AllowPrivate bool
+	// MaxRedirects defaults to DefaultMaxRedirects.
+	MaxRedirects int
+	// Timeout defaults to DefaultFetchTimeout.
+	Timeout time.Duration
+
+	once   sync.Once
+	client *http.Client
+}
+
+// DefaultFetcher is used by GetImage and Resize.
+var DefaultFetcher = &Fetcher{}
+
+func (f *Fetcher) init() {
+	f.once.Do(func() {
+		dialer := &net.Dialer{
+			Timeout: f.timeout(),
+			Control: f.control,
+		}
+		f.client = &http.Client{
+			Timeout: f.timeout(),
+			Transport: &http.Transport{
+				// No proxy: a proxy would connect on our behalf and
+				// bypass the address checks.
+				Proxy:               nil,
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: f.timeout(),
+				MaxIdleConnsPerHost: 4,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > f.maxRedirects() {
+					return ErrTooManyRedirects
+				}
+				return f.checkURL(req.URL)
+			},
+		}
+	})
+}
+
+func (f *Fetcher) timeout() time.Duration {
+	if f.Timeout > 0 {
+		return f.Timeout
+	}
+	return DefaultFetchTimeout
+}
+
+func (f *Fetcher) maxRedirects() int {
+	if f.MaxRedirects > 0 {
+		return f.MaxRedirects
+	}
+	return DefaultMaxRedirects
+}
+
+// control runs for every connection attempt with the resolved address.
+func (f *Fetcher) control(network, address string, _ syscall.RawConn) error {
+	if f.AllowPrivate {
+		return nil
+	}
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrAddressBlocked, address)
+	}
+	if AddressBlocked(ap.Addr()) {
+		return fmt.Errorf("%w: %s", ErrAddressBlocked, ap.Addr())
+	}
+	return nil
+}
+
+func (f *Fetcher) checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: %q", ErrSchemeNotAllowed, u.Scheme)
+	}
+	if !HostPermitted(f.PermittedHosts, u.Host) {
+		return fmt.Errorf("%w: %s", ErrHostNotPermitted, u.Host)
+	}
+	return nil
+}
+
+// Open requests rawURL with header, which may be nil, and returns the
+// response, whatever its status, for the caller to stream and close.
+// Unlike Get it does not limit the body.
+func (f *Fetcher) Open(rawURL string, header http.Header) (*http.Response, error) {
+	f.init()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.checkURL(u); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return f.client.Do(req)
+}
+
+// Get downloads rawURL, returning the body and its Cache-Control header.
+// Responses other than 2xx fail with an OriginStatusError, and bodies over
+// MaxSourceBytes with a SourceTooLargeError.
+func (f *Fetcher) Get(rawURL string) ([]byte, string, error) {
+	buf, h, err := f.fetch(rawURL)
+	return buf, h.Get("Cache-Control"), err
+}
+
+// fetch is Get returning every response header.
+func (f *Fetcher) fetch(rawURL string) ([]byte, http.Header, error) {
+	res, err := f.Open(rawURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, nil, &OriginStatusError{StatusCode: res.StatusCode}
+	}
+	buf, err := readSource(res)
+	return buf, res.Header, err
+}
+
+// readSource reads a response body of at most MaxSourceBytes.
+func readSource(res *http.Response) ([]byte, error) {
+	if res.ContentLength > MaxSourceBytes {
+		return nil, &SourceTooLargeError{Size: res.ContentLength, Limit: MaxSourceBytes}
+	}
+	// Content-Length may be missing or wrong, so the body is limited too.
+	buf, err := io.ReadAll(io.LimitReader(res.Body, MaxSourceBytes+1))
+	if int64(len(buf)) > MaxSourceBytes {
+		return nil, &SourceTooLargeError{Size: int64(len(buf)), Limit: MaxSourceBytes}
+	}
+	return buf, err
+}
@@ -0,0 +1,151 @@
+package asset_delivery
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAddressBlocked(t *testing.T) {
+	blocked := []string{
+		"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254",
+		"100.64.0.1", "0.0.0.0", "224.0.0.1", "255.255.255.255",
+		"::1", "::", "fe80::1", "fd00:ec2::254", "ff02::1", "::ffff:127.0.0.1", "64:ff9b::a00:1",
+	}
+	for _, s := range blocked {
+		if !AddressBlocked(netip.MustParseAddr(s)) {
+			t.Errorf("expected %s to be blocked", s)
+		}
+	}
+	for _, s := range []string{"8.8.8.8", "151.101.1.1", "2607:f8b0:4004:800::200e"} {
+		if AddressBlocked(netip.MustParseAddr(s)) {
+			t.Errorf("expected %s to be allowed", s)
+		}
+	}
+}
+
+func TestFetcher_Get(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			w.Write([]byte("ok"))
+		case "/to-localhost":
+			http.Redirect(w, r, strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)+"/ok", http.StatusFound)
+		case "/to-file":
+			http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		}
+	}))
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	cases := []struct {
+		Name    string
+		Fetcher *Fetcher
+		URL     string
+		Err     error
+	}{
+		{"loopback is blocked", &Fetcher{}, srv.URL + "/ok", ErrAddressBlocked},
+		{"names resolving to loopback are blocked", &Fetcher{}, strings.Replace(srv.URL, "127.0.0.1", "localhost", 1) + "/ok", ErrAddressBlocked},
+		{"metadata service is blocked", &Fetcher{}, "http://169.254.169.254/computeMetadata/v1/", ErrAddressBlocked},
+		{"file scheme", &Fetcher{}, "file:///etc/passwd", ErrSchemeNotAllowed},
+		{"gopher scheme", &Fetcher{}, "gopher://127.0.0.1:6379/_INFO", ErrSchemeNotAllowed},
+		{"host not permitted", &Fetcher{AllowPrivate: true, PermittedHosts: []string{"*.monstercat.com"}}, srv.URL + "/ok", ErrHostNotPermitted},
+		{"permitted", &Fetcher{AllowPrivate: true, PermittedHosts: []string{host}}, srv.URL + "/ok", nil},
+		{"redirect to a host not permitted", &Fetcher{AllowPrivate: true, PermittedHosts: []string{host}}, srv.URL + "/to-localhost", ErrHostNotPermitted},
+		{"redirect to another scheme", &Fetcher{AllowPrivate: true}, srv.URL + "/to-file", ErrSchemeNotAllowed},
+		{"redirect loop", &Fetcher{AllowPrivate: true, MaxRedirects: 2}, srv.URL + "/loop", ErrTooManyRedirects},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			buf, _, err := c.Fetcher.Get(c.URL)
+			if c.Err == nil {
+				if err != nil || string(buf) != "ok" {
+					t.Fatalf("expected ok, got %q, %v", buf, err)
+				}
+				return
+			}
+			if !errors.Is(err, c.Err) {
+				t.Fatalf("expected %v, got %v", c.Err, err)
+			}
+		})
+	}
+}
+
+func TestFetchError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		w.WriteHeader(code)
+	}))
+	defer srv.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	cases := []struct {
+		Name    string
+		Fetcher *Fetcher
+		URL     string
+		Status  int
+	}{
+		{"not found", &Fetcher{AllowPrivate: true}, srv.URL + "/404", http.StatusBadRequest},
+		{"gone", &Fetcher{AllowPrivate: true}, srv.URL + "/410", http.StatusBadRequest},
+		{"rate limited", &Fetcher{AllowPrivate: true}, srv.URL + "/429", http.StatusInternalServerError},
+		{"origin error", &Fetcher{AllowPrivate: true}, srv.URL + "/502", http.StatusInternalServerError},
+		{"connection refused", &Fetcher{AllowPrivate: true}, closed.URL + "/", http.StatusInternalServerError},
+		{"address blocked", &Fetcher{}, srv.URL + "/200", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			_, _, err := c.Fetcher.Get(c.URL)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if status := ErrorStatus(fetchError(c.URL, err)); status != c.Status {
+				t.Fatalf("expected %d for %v, got %d", c.Status, err, status)
+			}
+		})
+	}
+}
+
+func TestFetcher_SourceTooLarge(t *testing.T) {
+	f := &Fetcher{AllowPrivate: true}
+	maxBytes := MaxSourceBytes
+	MaxSourceBytes = 8
+	defer func() { MaxSourceBytes = maxBytes }()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/streamed" {
+			// Flushing before the body is complete drops Content-Length.
+			w.Write([]byte("01234"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("56789"))
+			return
+		}
+		w.Write([]byte("0123456789"))
+	}))
+	defer srv.Close()
+
+	for _, path := range []string{"/sized", "/streamed"} {
+		t.Run(path, func(t *testing.T) {
+			_, _, err := f.Get(srv.URL + path)
+			tooLarge, ok := err.(*SourceTooLargeError)
+			if !ok {
+				t.Fatalf("expected a SourceTooLargeError, got %v", err)
+			}
+			if ErrorStatus(tooLarge) != http.StatusRequestEntityTooLarge {
+				t.Fatalf("expected 413, got %d", ErrorStatus(tooLarge))
+			}
+		})
+	}
+
+	MaxSourceBytes = 10
+	if buf, _, err := f.Get(srv.URL + "/sized"); err != nil || len(buf) != 10 {
+		t.Fatalf("expected a body at the limit to be read, got %d bytes, %v", len(buf), err)
+	}
+}
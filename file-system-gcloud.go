@@ -2,13 +2,17 @@ package asset_delivery
 
 import (
 	"context"
+	"errors"
 	"io"
 	"log"
+	"net/http"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
 )
 
 type GCloudFileInfo struct {
@@ -23,6 +27,20 @@ func (i *GCloudFileInfo) Created() time.Time {
 	return i.attributes.LastModified
 }
 
+func (i *GCloudFileInfo) ContentType() string {
+	return i.attributes.ContentType
+}
+
+func (i *GCloudFileInfo) Size() int64 {
+	return i.attributes.Size
+}
+
+// ETag is derived from the object generation, which changes whenever the
+// object is rewritten.
+func (i *GCloudFileInfo) ETag() string {
+	return `"` + strconv.FormatInt(i.attributes.Generation, 10) + `"`
+}
+
 type GCloudFileSystem struct {
 	Client *storage.Client
 	Host   string
@@ -83,6 +101,9 @@ func (fs *GCloudFileSystem) Info(filename string) (FileInfo, error) {
 func (fs *GCloudFileSystem) ReadCloser(filename string) (io.ReadCloser, error) {
 	handle := fs.Client.Bucket(fs.Bucket).Object(filename)
 	r, err := handle.NewReader(context.Background())
+	if err == storage.ErrObjectNotExist {
+		return nil, ErrNoFile
+	}
 	return r, err
 }
 
@@ -94,6 +115,7 @@ func (fs *GCloudFileSystem) Write(filename string, r io.Reader, info FileInfoWri
 	handle := bucket.Object(filename)
 	w := handle.NewWriter(context.Background())
 	w.CacheControl = info.CacheControl()
+	w.ContentType = contentTypeOf(info)
 	defer w.Close()
 	_, err := io.Copy(w, r)
 	return err
@@ -101,5 +123,63 @@ func (fs *GCloudFileSystem) Write(filename string, r io.Reader, info FileInfoWri
 
 func (fs *GCloudFileSystem) Delete(filename string) error {
 	handle := fs.Client.Bucket(fs.Bucket).Object(filename)
-	return handle.Delete(context.Background())
+	err := handle.Delete(context.Background())
+	if err == storage.ErrObjectNotExist {
+		return ErrNoFile
+	}
+	return err
+}
+
+// Lease writes a marker object next to key with a does-not-exist
+// precondition. Expired markers are taken over, and markers released,
+// with a generation-match precondition.
+func (fs *GCloudFileSystem) Lease(key string, ttl time.Duration) (func() error, error) {
+	handle := fs.Client.Bucket(fs.Bucket).Object(key + leaseSuffix)
+	ctx := context.Background()
+	write := func(conds storage.Conditions) (string, error) {
+		w := handle.If(conds).NewWriter(ctx)
+		err := w.Close()
+		var gerr *googleapi.Error
+		if errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed {
+			return "", ErrLeaseHeld
+		}
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(w.Attrs().Generation, 10), nil
+	}
+	return leaseMarker{
+		create: func() (string, error) {
+			return write(storage.Conditions{DoesNotExist: true})
+		},
+		stat: func() (time.Time, string, error) {
+			attrs, err := handle.Attrs(ctx)
+			if err == storage.ErrObjectNotExist {
+				return time.Time{}, "", ErrNoFile
+			}
+			if err != nil {
+				return time.Time{}, "", err
+			}
+			return attrs.Created, strconv.FormatInt(attrs.Generation, 10), nil
+		},
+		replace: func(version string) (string, error) {
+			gen, err := strconv.ParseInt(version, 10, 64)
+			if err != nil {
+				return "", err
+			}
+			return write(storage.Conditions{GenerationMatch: gen})
+		},
+		remove: func(version string) error {
+			gen, err := strconv.ParseInt(version, 10, 64)
+			if err != nil {
+				return err
+			}
+			err = handle.If(storage.Conditions{GenerationMatch: gen}).Delete(ctx)
+			var gerr *googleapi.Error
+			if err == storage.ErrObjectNotExist || errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed {
+				return ErrNoFile
+			}
+			return err
+		},
+	}.acquire(ttl)
 }
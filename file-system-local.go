@@ -0,0 +1,329 @@
+package asset_delivery
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// localMetaSuffix is appended to an object's path to name the sidecar file
+// holding its LocalFileInfo. Keys may not end with it.
+const localMetaSuffix = ".meta.json"
+
+var (
+	ErrInvalidVolume = errors.New("invalid volume name")
+	ErrReservedKey   = errors.New("key ends with a reserved suffix")
+)
+
+// LocalFileInfo is the metadata stored next to each object written by a
+// LocalFileSystem.
+type LocalFileInfo struct {
+	Control   string    `json:"cacheControl"`
+	CreatedAt time.Time `json:"created"`
+	Type      string    `json:"contentType,omitempty"`
+
+	// Length and Tag come from the object file itself.
+	Length int64  `json:"-"`
+	Tag    string `json:"-"`
+}
+
+func (i *LocalFileInfo) CacheControl() string {
+	return i.Control
+}
+
+func (i *LocalFileInfo) Created() time.Time {
+	return i.CreatedAt
+}
+
+func (i *LocalFileInfo) ContentType() string {
+	return i.Type
+}
+
+func (i *LocalFileInfo) Size() int64 {
+	return i.Length
+}
+
+func (i *LocalFileInfo) ETag() string {
+	return i.Tag
+}
+
+// LocalFileSystem stores objects on disk under Root/Volume. Cache-Control
+// and creation time are kept in a JSON sidecar file so that expiry checks
+// behave the same way they do against a bucket.
+type LocalFileSystem struct {
+	Root   string
+	Volume string
+
+	// Host is prepended to object names by ObjectURL. It should point at
+	// whatever serves Root (e.g. http://localhost:8081). When empty, file://
+	// URLs are returned.
+	Host string
+}
+
+func NewLocalFileSystem(root string) (*LocalFileSystem, error) {
+	if root == "" {
+		return nil, errors.New("local file system root missing")
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	volume := os.Getenv("BUCKET")
+	if err := validVolume(volume); err != nil {
+		return nil, err
+	}
+	return &LocalFileSystem{
+		Root:   root,
+		Volume: volume,
+		Host:   os.Getenv("HOST"),
+	}, nil
+}
+
+// validVolume checks that name is a single directory under the root. An
+// empty name stores objects in the root itself.
+func validVolume(name string) error {
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return ErrInvalidVolume
+	}
+	return nil
+}
+
+// objectPath maps filename onto the volume directory. The name is cleaned
+// as if it were rooted so that it can never escape the volume, and may not
+// end with localMetaSuffix so that it can never be another object's
+// sidecar.
+func (fs *LocalFileSystem) objectPath(filename string) (string, error) {
+	if err := validVolume(fs.Volume); err != nil {
+		return "", err
+	}
+	clean := path.Clean("/" + filename)
+	if strings.HasSuffix(clean, localMetaSuffix) {
+		return "", ErrReservedKey
+	}
+	return filepath.Join(fs.Root, fs.Volume, filepath.FromSlash(clean)), nil
+}
+
+// FromVolume returns the file system of another volume. Operations on it
+// fail with ErrInvalidVolume if name is not a single directory name.
+func (fs *LocalFileSystem) FromVolume(name string) FileSystem {
+	return &LocalFileSystem{
+		Root:   fs.Root,
+		Volume: name,
+		Host:   fs.Host,
+	}
+}
+
+func (fs *LocalFileSystem) ObjectURL(filename string) string {
+	host := strings.TrimSpace(fs.Host)
+	if host == "" {
+		p, err := fs.objectPath(filename)
+		if err != nil {
+			return ""
+		}
+		return "file://" + filepath.ToSlash(p)
+	}
+	return strings.TrimSuffix(host, "/") + path.Join("/", fs.Volume, filename)
+}
+
+func (fs *LocalFileSystem) Info(filename string) (FileInfo, error) {
+	p, err := fs.objectPath(filename)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoFile
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info := &LocalFileInfo{
+		CreatedAt: stat.ModTime(),
+		Type:      mime.TypeByExtension(filepath.Ext(p)),
+		Length:    stat.Size(),
+		// Objects are replaced by rename, so the modification time and
+		// size change with every write.
+		Tag: fmt.Sprintf(`"%x-%x"`, stat.ModTime().UnixNano(), stat.Size()),
+	}
+	b, err := os.ReadFile(p + localMetaSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		// Objects copied in by hand have no sidecar; fall back to the file
+		// modification time, the extension's type and no Cache-Control.
+		return info, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (fs *LocalFileSystem) ReadCloser(filename string) (io.ReadCloser, error) {
+	p, err := fs.objectPath(filename)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoFile
+	}
+	return f, err
+}
+
+// Write stores the object and its sidecar. Both are written to temporary
+// files and renamed into place so readers never see a partial object.
+func (fs *LocalFileSystem) Write(filename string, r io.Reader, info FileInfoWrite) error {
+	p, err := fs.objectPath(filename)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(p, r); err != nil {
+		return err
+	}
+	meta, err := json.Marshal(&LocalFileInfo{
+		Control:   info.CacheControl(),
+		CreatedAt: time.Now().UTC(),
+		Type:      contentTypeOf(info),
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(p+localMetaSuffix, bytes.NewReader(meta))
+}
+
+func (fs *LocalFileSystem) Delete(filename string) error {
+	p, err := fs.objectPath(filename)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNoFile
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p + localMetaSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// localLeaseMu serializes lease takeovers and releases. They are only
+// atomic within a process; processes sharing a Root may both take over the
+// same expired lease.
+var localLeaseMu sync.Mutex
+
+// Lease creates a marker file next to key with O_EXCL. The marker holds a
+// random token, which is its version for takeovers and releases.
+func (fs *LocalFileSystem) Lease(key string, ttl time.Duration) (func() error, error) {
+	p, err := fs.objectPath(key)
+	if err != nil {
+		return nil, err
+	}
+	p += leaseSuffix
+	// current reports whether the marker still holds version.
+	current := func(version string) (bool, error) {
+		b, err := os.ReadFile(p)
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return string(b) == version, err
+	}
+	return leaseMarker{
+		create: func() (string, error) {
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return "", err
+			}
+			f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+			if errors.Is(err, os.ErrExist) {
+				return "", ErrLeaseHeld
+			}
+			if err != nil {
+				return "", err
+			}
+			token := leaseToken()
+			if _, err := io.WriteString(f, token); err != nil {
+				f.Close()
+				return "", err
+			}
+			return token, f.Close()
+		},
+		stat: func() (time.Time, string, error) {
+			stat, err := os.Stat(p)
+			if err == nil {
+				var b []byte
+				if b, err = os.ReadFile(p); err == nil {
+					return stat.ModTime(), string(b), nil
+				}
+			}
+			if errors.Is(err, os.ErrNotExist) {
+				return time.Time{}, "", ErrNoFile
+			}
+			return time.Time{}, "", err
+		},
+		replace: func(version string) (string, error) {
+			localLeaseMu.Lock()
+			defer localLeaseMu.Unlock()
+			ok, err := current(version)
+			if err != nil {
+				return "", err
+			}
+			if !ok {
+				return "", ErrLeaseHeld
+			}
+			token := leaseToken()
+			return token, writeFileAtomic(p, strings.NewReader(token))
+		},
+		remove: func(version string) error {
+			localLeaseMu.Lock()
+			defer localLeaseMu.Unlock()
+			ok, err := current(version)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return ErrNoFile
+			}
+			err = os.Remove(p)
+			if errors.Is(err, os.ErrNotExist) {
+				return ErrNoFile
+			}
+			return err
+		},
+	}.acquire(ttl)
+}
+
+func writeFileAtomic(p string, r io.Reader) error {
+	tmp, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
@@ -0,0 +1,158 @@
+package asset_delivery
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalFileSystem(t *testing.T) {
+	root := t.TempDir()
+	fs := &LocalFileSystem{Root: root, Volume: "bucket"}
+
+	if _, err := fs.Info("resized/abc/100.webp"); err != ErrNoFile {
+		t.Fatalf("expected ErrNoFile before write, got %v", err)
+	}
+
+	before := time.Now().Add(-time.Second)
+	err := fs.Write("resized/abc/100.webp", strings.NewReader("data"), &WriteInfo{cacheControl: "max-age=60", contentType: "image/webp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := fs.Info("resized/abc/100.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.CacheControl() != "max-age=60" {
+		t.Errorf("expected cache control to round trip, got %q", info.CacheControl())
+	}
+	if info.Created().Before(before) {
+		t.Errorf("expected created time after %s, got %s", before, info.Created())
+	}
+	obj, ok := info.(FileInfoObject)
+	if !ok {
+		t.Fatalf("expected %T to implement FileInfoObject", info)
+	}
+	if obj.ContentType() != "image/webp" || obj.Size() != 4 || obj.ETag() == "" {
+		t.Errorf("unexpected object attributes %q, %d, %q", obj.ContentType(), obj.Size(), obj.ETag())
+	}
+
+	r, err := fs.ReadCloser("resized/abc/100.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "data" {
+		t.Errorf("expected object contents %q, got %q", "data", b)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "bucket", "resized", "abc", "100.webp")); err != nil {
+		t.Errorf("expected object stored under the volume directory: %s", err)
+	}
+
+	if err := fs.Delete("resized/abc/100.webp"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Info("resized/abc/100.webp"); err != ErrNoFile {
+		t.Fatalf("expected ErrNoFile after delete, got %v", err)
+	}
+}
+
+func TestLocalFileSystem_FromVolume(t *testing.T) {
+	fs := &LocalFileSystem{Root: t.TempDir(), Volume: "a", Host: "http://localhost:8081"}
+	if err := fs.Write("key", strings.NewReader("a"), &WriteInfo{}); err != nil {
+		t.Fatal(err)
+	}
+
+	other := fs.FromVolume("b")
+	if _, err := other.Info("key"); err != ErrNoFile {
+		t.Fatalf("expected volumes to be isolated, got %v", err)
+	}
+	if url := other.ObjectURL("key"); url != "http://localhost:8081/b/key" {
+		t.Errorf("unexpected object url %q", url)
+	}
+}
+
+func TestLocalFileSystem_StaysInsideVolume(t *testing.T) {
+	root := t.TempDir()
+	fs := &LocalFileSystem{Root: root, Volume: "bucket"}
+	if err := fs.Write("../../escape", strings.NewReader("x"), &WriteInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "bucket", "escape")); err != nil {
+		t.Errorf("expected traversal to be clamped to the volume: %s", err)
+	}
+}
+
+func TestLocalFileSystem_RejectsInvalidVolume(t *testing.T) {
+	fs := &LocalFileSystem{Root: t.TempDir(), Volume: "bucket"}
+	for _, name := range []string{"..", "../x", "a/b", `a\b`} {
+		if err := fs.FromVolume(name).Write("key", strings.NewReader("x"), &WriteInfo{}); err != ErrInvalidVolume {
+			t.Errorf("%q: expected ErrInvalidVolume, got %v", name, err)
+		}
+	}
+}
+
+func TestLocalFileSystem_ReservesMetaSuffix(t *testing.T) {
+	fs := &LocalFileSystem{Root: t.TempDir(), Volume: "bucket"}
+	if err := fs.Write("key", strings.NewReader("x"), &WriteInfo{cacheControl: "max-age=60"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Write("key"+localMetaSuffix, strings.NewReader("{}"), &WriteInfo{}); err != ErrReservedKey {
+		t.Fatalf("expected ErrReservedKey, got %v", err)
+	}
+	if _, err := fs.Info("key" + localMetaSuffix); err != ErrReservedKey {
+		t.Fatalf("expected ErrReservedKey, got %v", err)
+	}
+	info, err := fs.Info("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.CacheControl() != "max-age=60" {
+		t.Errorf("expected metadata to be intact, got %q", info.CacheControl())
+	}
+}
+
+func TestLocalFileSystem_Lease(t *testing.T) {
+	fs := &LocalFileSystem{Root: t.TempDir(), Volume: "bucket"}
+	key := "resized/abc/100.webp"
+
+	release, err := fs.Lease(key, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Lease(key, time.Minute); err != ErrLeaseHeld {
+		t.Fatalf("expected ErrLeaseHeld, got %v", err)
+	}
+	if err := release(); err != nil {
+		t.Fatal(err)
+	}
+	expired, err := fs.Lease(key, time.Minute)
+	if err != nil {
+		t.Fatalf("expected a released lease to be available, got %v", err)
+	}
+
+	// A lease past its TTL belongs to a worker that died; take it over.
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(fs.Root, fs.Volume, key)+leaseSuffix, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Lease(key, time.Minute); err != nil {
+		t.Fatalf("expected an expired lease to be taken over, got %v", err)
+	}
+	// The slow holder's release leaves its successor's lease alone.
+	if err := expired(); err != ErrNoFile {
+		t.Fatalf("expected ErrNoFile releasing a taken over lease, got %v", err)
+	}
+	if _, err := fs.Lease(key, time.Minute); err != ErrLeaseHeld {
+		t.Fatalf("expected the new holder to keep the lease, got %v", err)
+	}
+}
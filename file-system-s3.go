@@ -0,0 +1,230 @@
+package asset_delivery
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const defaultS3Endpoint = "s3.amazonaws.com"
+
+type S3FileInfo struct {
+	info minio.ObjectInfo
+}
+
+func (i *S3FileInfo) CacheControl() string {
+	return i.info.Metadata.Get("Cache-Control")
+}
+
+func (i *S3FileInfo) Created() time.Time {
+	return i.info.LastModified
+}
+
+func (i *S3FileInfo) ContentType() string {
+	return i.info.ContentType
+}
+
+func (i *S3FileInfo) Size() int64 {
+	return i.info.Size
+}
+
+// ETag quotes the object's ETag, which minio returns bare.
+func (i *S3FileInfo) ETag() string {
+	if i.info.ETag == "" {
+		return ""
+	}
+	return `"` + strings.Trim(i.info.ETag, `"`) + `"`
+}
+
+// S3FileSystem stores objects in an S3-compatible bucket (AWS, MinIO, ...).
+type S3FileSystem struct {
+	Client *minio.Client
+	Host   string
+	Bucket string
+}
+
+// NewS3FileSystem connects to the endpoint in S3_ENDPOINT (defaulting to
+// AWS). The endpoint may carry an http:// scheme for local stand-ins such
+// as MinIO. Credentials are read from the AWS_* or MINIO_* environment
+// variables, falling back to the instance's IAM role.
+func NewS3FileSystem() (*S3FileSystem, error) {
+	endpoint := strings.TrimSpace(os.Getenv("S3_ENDPOINT"))
+	if endpoint == "" {
+		endpoint = defaultS3Endpoint
+	}
+	secure := true
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		secure = u.Scheme != "http"
+		endpoint = u.Host
+	}
+
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport}},
+	})
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: secure,
+		Region: os.Getenv("S3_REGION"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3FileSystem{
+		Client: client,
+		Bucket: os.Getenv("BUCKET"),
+		Host:   os.Getenv("HOST"),
+	}, nil
+}
+
+func isS3NotExist(err error) bool {
+	res := minio.ToErrorResponse(err)
+	return res.Code == minio.NoSuchKey || res.StatusCode == http.StatusNotFound
+}
+
+func (fs *S3FileSystem) FromVolume(name string) FileSystem {
+	return &S3FileSystem{
+		Client: fs.Client,
+		Host:   fs.Host,
+		Bucket: name,
+	}
+}
+
+// ObjectURL uses path-style addressing against the client's endpoint when
+// no Host is configured, which works for both AWS and local stand-ins.
+func (fs *S3FileSystem) ObjectURL(filename string) string {
+	host := strings.TrimSpace(fs.Host)
+	if host == "" {
+		host = strings.TrimSuffix(fs.Client.EndpointURL().String(), "/") + "/" + fs.Bucket
+	}
+	return host + path.Join("/", filename)
+}
+
+func (fs *S3FileSystem) Info(filename string) (FileInfo, error) {
+	info, err := fs.Client.StatObject(context.Background(), fs.Bucket, filename, minio.StatObjectOptions{})
+	if err != nil {
+		if isS3NotExist(err) {
+			return nil, ErrNoFile
+		}
+		return nil, err
+	}
+	return &S3FileInfo{info}, nil
+}
+
+func (fs *S3FileSystem) ReadCloser(filename string) (io.ReadCloser, error) {
+	obj, err := fs.Client.GetObject(context.Background(), fs.Bucket, filename, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy; stat it so a missing object is reported here
+	// rather than on the first Read.
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		if isS3NotExist(err) {
+			return nil, ErrNoFile
+		}
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (fs *S3FileSystem) Write(filename string, r io.Reader, info FileInfoWrite) error {
+	size := int64(-1)
+	if v, ok := r.(interface{ Len() int }); ok {
+		size = int64(v.Len())
+	}
+	_, err := fs.Client.PutObject(context.Background(), fs.Bucket, filename, r, size, minio.PutObjectOptions{
+		CacheControl: info.CacheControl(),
+		ContentType:  contentTypeOf(info),
+	})
+	return err
+}
+
+// Delete stats the object first, since S3 reports success when deleting a
+// missing key and callers rely on ErrNoFile as with the other backends.
+func (fs *S3FileSystem) Delete(filename string) error {
+	ctx := context.Background()
+	if _, err := fs.Client.StatObject(ctx, fs.Bucket, filename, minio.StatObjectOptions{}); err != nil {
+		if isS3NotExist(err) {
+			return ErrNoFile
+		}
+		return err
+	}
+	err := fs.Client.RemoveObject(ctx, fs.Bucket, filename, minio.RemoveObjectOptions{})
+	if err != nil && isS3NotExist(err) {
+		return ErrNoFile
+	}
+	return err
+}
+
+// Lease writes a marker object next to key with If-None-Match: *. Expired
+// markers are taken over with If-Match on their ETag; every marker has a
+// random body so that the ETags differ. Stores that ignore the
+// preconditions let every caller take the lease.
+func (fs *S3FileSystem) Lease(key string, ttl time.Duration) (func() error, error) {
+	name := key + leaseSuffix
+	ctx := context.Background()
+	write := func(opts minio.PutObjectOptions) (string, error) {
+		token := leaseToken()
+		info, err := fs.Client.PutObject(ctx, fs.Bucket, name, strings.NewReader(token), int64(len(token)), opts)
+		if err != nil {
+			// 409 is returned for a conflicting write still in flight, and
+			// 404 for an If-Match on a marker released in the meantime.
+			switch minio.ToErrorResponse(err).StatusCode {
+			case http.StatusPreconditionFailed, http.StatusConflict, http.StatusNotFound:
+				return "", ErrLeaseHeld
+			}
+			return "", err
+		}
+		return strings.Trim(info.ETag, `"`), nil
+	}
+	stat := func() (time.Time, string, error) {
+		info, err := fs.Client.StatObject(ctx, fs.Bucket, name, minio.StatObjectOptions{})
+		if err != nil {
+			if isS3NotExist(err) {
+				return time.Time{}, "", ErrNoFile
+			}
+			return time.Time{}, "", err
+		}
+		return info.LastModified, strings.Trim(info.ETag, `"`), nil
+	}
+	return leaseMarker{
+		create: func() (string, error) {
+			opts := minio.PutObjectOptions{}
+			opts.SetMatchETagExcept("*")
+			return write(opts)
+		},
+		stat: stat,
+		replace: func(version string) (string, error) {
+			opts := minio.PutObjectOptions{}
+			opts.SetMatchETag(version)
+			return write(opts)
+		},
+		// S3 deletes take no precondition, so the ETag is compared first.
+		// A takeover landing between the two is the only way to remove
+		// another holder's marker, and needs this lease to have expired.
+		remove: func(version string) error {
+			_, current, err := stat()
+			if err != nil {
+				return err
+			}
+			if current != version {
+				return ErrNoFile
+			}
+			err = fs.Client.RemoveObject(ctx, fs.Bucket, name, minio.RemoveObjectOptions{})
+			if err != nil && isS3NotExist(err) {
+				return ErrNoFile
+			}
+			return err
+		},
+	}.acquire(ttl)
+}
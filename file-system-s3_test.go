@@ -0,0 +1,227 @@
+package asset_delivery
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type s3Object struct {
+	data         []byte
+	cacheControl string
+	contentType  string
+	modified     time.Time
+}
+
+// s3Stub is an in-memory, path-style S3 endpoint covering the calls
+// S3FileSystem makes.
+type s3Stub struct {
+	mu      sync.Mutex
+	objects map[string]*s3Object
+}
+
+func (s *s3Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	obj := s.objects[key]
+
+	switch r.Method {
+	case http.MethodPut:
+		if obj != nil && r.Header.Get("If-None-Match") == "*" {
+			s3StubError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if match := r.Header.Get("If-Match"); match != "" {
+			if obj == nil {
+				s3StubError(w, http.StatusNotFound, "NoSuchKey")
+				return
+			}
+			if match != obj.etag() {
+				s3StubError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+				return
+			}
+		}
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			s3StubError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		obj = &s3Object{
+			data:         b,
+			cacheControl: r.Header.Get("Cache-Control"),
+			contentType:  r.Header.Get("Content-Type"),
+			modified:     time.Now().UTC().Truncate(time.Second),
+		}
+		s.objects[key] = obj
+		w.Header().Set("ETag", obj.etag())
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead, http.MethodGet:
+		if obj == nil {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			s3StubError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		h := w.Header()
+		h.Set("ETag", obj.etag())
+		h.Set("Last-Modified", obj.modified.Format(http.TimeFormat))
+		h.Set("Content-Length", strconv.Itoa(len(obj.data)))
+		h.Set("Content-Type", obj.contentType)
+		if obj.cacheControl != "" {
+			h.Set("Cache-Control", obj.cacheControl)
+		}
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+	case http.MethodDelete:
+		// Like S3, deleting a missing key succeeds.
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3StubError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (o *s3Object) etag() string {
+	sum := md5.Sum(o.data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func s3StubError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, "<Error><Code>"+code+"</Code><Message>"+code+"</Message></Error>")
+}
+
+func newTestS3FileSystem(t *testing.T) (*S3FileSystem, *s3Stub) {
+	t.Helper()
+	stub := &s3Stub{objects: make(map[string]*s3Object)}
+	// TLS keeps minio from using chunked payload signing.
+	srv := httptest.NewTLSServer(stub)
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:     credentials.NewStaticV4("key", "secret", ""),
+		Secure:    true,
+		Region:    "us-east-1",
+		Transport: srv.Client().Transport,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &S3FileSystem{Client: client, Bucket: "bucket"}, stub
+}
+
+func TestS3FileSystem(t *testing.T) {
+	fs, _ := newTestS3FileSystem(t)
+	key := "resized/abc/100.webp"
+
+	if _, err := fs.Info(key); err != ErrNoFile {
+		t.Fatalf("expected ErrNoFile before write, got %v", err)
+	}
+	if _, err := fs.ReadCloser(key); err != ErrNoFile {
+		t.Fatalf("expected ErrNoFile before write, got %v", err)
+	}
+
+	err := fs.Write(key, strings.NewReader("data"), &WriteInfo{cacheControl: "max-age=60", contentType: "image/webp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := fs.Info(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.CacheControl() != "max-age=60" {
+		t.Errorf("expected cache control to round trip, got %q", info.CacheControl())
+	}
+	if info.Created().IsZero() {
+		t.Error("expected a creation time")
+	}
+	obj := info.(FileInfoObject)
+	if obj.ContentType() != "image/webp" || obj.Size() != 4 || !strings.HasPrefix(obj.ETag(), `"`) {
+		t.Errorf("unexpected object attributes %q, %d, %q", obj.ContentType(), obj.Size(), obj.ETag())
+	}
+
+	r, err := fs.ReadCloser(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "data" {
+		t.Errorf("expected object contents %q, got %q", "data", b)
+	}
+
+	if err := fs.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Info(key); err != ErrNoFile {
+		t.Fatalf("expected ErrNoFile after delete, got %v", err)
+	}
+	if err := fs.Delete(key); err != ErrNoFile {
+		t.Fatalf("expected ErrNoFile deleting a missing key, got %v", err)
+	}
+}
+
+func TestS3FileSystem_Lease(t *testing.T) {
+	fs, stub := newTestS3FileSystem(t)
+	key := "resized/abc/100.webp"
+
+	release, err := fs.Lease(key, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Lease(key, time.Minute); err != ErrLeaseHeld {
+		t.Fatalf("expected ErrLeaseHeld, got %v", err)
+	}
+	if err := release(); err != nil {
+		t.Fatal(err)
+	}
+	expired, err := fs.Lease(key, time.Minute)
+	if err != nil {
+		t.Fatalf("expected a released lease to be available, got %v", err)
+	}
+
+	// A lease past its TTL belongs to a worker that died; take it over.
+	stub.mu.Lock()
+	stale := stub.objects["bucket/"+key+leaseSuffix]
+	stale.modified = stale.modified.Add(-time.Hour)
+	stub.mu.Unlock()
+	if _, err := fs.Lease(key, time.Minute); err != nil {
+		t.Fatalf("expected an expired lease to be taken over, got %v", err)
+	}
+	// The slow holder's release leaves its successor's lease alone.
+	if err := expired(); err != ErrNoFile {
+		t.Fatalf("expected ErrNoFile releasing a taken over lease, got %v", err)
+	}
+	if _, err := fs.Lease(key, time.Minute); err != ErrLeaseHeld {
+		t.Fatalf("expected the new holder to keep the lease, got %v", err)
+	}
+	stub.mu.Lock()
+	taken := stub.objects["bucket/"+key+leaseSuffix]
+	stub.mu.Unlock()
+	if taken.etag() == stale.etag() {
+		t.Fatal("expected the takeover to write a new marker")
+	}
+}
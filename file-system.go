@@ -2,8 +2,13 @@ package asset_delivery
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"os"
+	"strings"
 	"time"
+
+	"google.golang.org/api/option"
 )
 
 var ErrNoFile = errors.New("no file")
@@ -30,3 +35,50 @@ type FileInfo interface {
 	FileInfoRead
 }
 
+// FileInfoContentType is optionally implemented by the FileInfoWrite
+// passed to Write, to store the object's Content-Type.
+type FileInfoContentType interface {
+	ContentType() string
+}
+
+// FileInfoObject is optionally implemented by the FileInfo a FileSystem
+// returns, with the attributes needed to serve the object directly rather
+// than redirect to its ObjectURL. Size is -1 and ETag empty when unknown.
+type FileInfoObject interface {
+	FileInfo
+	FileInfoContentType
+	Size() int64
+	ETag() string
+}
+
+// contentTypeOf returns the Content-Type carried by info, if any.
+func contentTypeOf(info FileInfoWrite) string {
+	if v, ok := info.(FileInfoContentType); ok {
+		return v.ContentType()
+	}
+	return ""
+}
+
+
+// NewFileSystem creates the FileSystem for the named backend: "gcloud"
+// (the default), "s3" or "local". Each backend reads its own settings from
+// the environment; see the README. The client options only apply to
+// gcloud.
+func NewFileSystem(backend string, opts ...option.ClientOption) (FileSystem, error) {
+	var fs FileSystem
+	var err error
+	switch strings.ToLower(strings.TrimSpace(backend)) {
+	case "", "gcloud", "gcs":
+		fs, err = NewGCloudFileSystem(opts...)
+	case "s3":
+		fs, err = NewS3FileSystem()
+	case "local":
+		fs, err = NewLocalFileSystem(os.Getenv("LOCAL_ROOT"))
+	default:
+		return nil, fmt.Errorf("unknown file system backend %q", backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
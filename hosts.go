@@ -0,0 +1,38 @@
+package asset_delivery
+
+import "strings"
+
+// HostPermitted reports whether host matches one of patterns. Only an
+// empty list permits any host; the [""] produced by splitting an empty
+// -allow flag permits none.
+func HostPermitted(patterns []string, host string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, x := range patterns {
+		if HostMatchesPattern(strings.TrimSpace(x), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// HostMatchesPattern will test the hosts, allowing for a * pattern (separated by .). Note that the host should still
+// contain the same # of parts. For example, *.monstercat.com will not match with beta.app.monstercat.com.
+func HostMatchesPattern(pattern, host string) bool {
+	patternParts := strings.Split(pattern, ".")
+	hostParts := strings.Split(host, ".")
+	if len(hostParts) != len(patternParts) {
+		return false
+	}
+	for i, p := range patternParts {
+		curr := hostParts[i]
+		if p == "*" {
+			continue
+		}
+		if curr != p {
+			return false
+		}
+	}
+	return true
+}
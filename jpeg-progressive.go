@@ -0,0 +1,456 @@
+package asset_delivery
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+var ErrInvalidJPEG = errors.New("invalid jpeg data")
+
+// progressiveBands are the spectral selections of the AC scans written for
+// each component, after a first scan of every component's DC coefficient.
+var progressiveBands = [][2]int{{1, 5}, {6, 63}}
+
+type jpegHuffman struct {
+	// Decoding, as in ITU T.81 F.2.2.3.
+	maxCode [17]int32
+	valPtr  [17]int32
+	minCode [17]int32
+	values  []byte
+	// Encoding.
+	codes [256]uint16
+	sizes [256]uint8
+}
+
+func newJPEGHuffman(counts []byte, values []byte) *jpegHuffman {
+	h := &jpegHuffman{values: values}
+	code, k := int32(0), int32(0)
+	for l := 1; l <= 16; l++ {
+		n := int32(counts[l-1])
+		h.maxCode[l] = -1
+		if n > 0 {
+			h.valPtr[l] = k
+			h.minCode[l] = code
+			for i := int32(0); i < n; i++ {
+				h.codes[values[k+i]] = uint16(code + i)
+				h.sizes[values[k+i]] = uint8(l)
+			}
+			code += n
+			k += n
+			h.maxCode[l] = code - 1
+		}
+		code <<= 1
+	}
+	return h
+}
+
+type jpegComponent struct {
+	id, h, v byte
+	// td and ta select the DC and AC Huffman tables.
+	td, ta byte
+	// bw and bh count the blocks that cover the component; stride is the
+	// width, in blocks, of the MCU-padded grid blocks is stored in.
+	bw, bh, stride int
+	blocks         [][64]int32
+}
+
+// jpegFrame is a baseline JPEG decoded down to its quantized coefficients.
+type jpegFrame struct {
+	// tables holds the segments before the scan other than the frame
+	// header: quantization and Huffman tables, and application data.
+	tables     []byte
+	sof        []byte
+	components []*jpegComponent
+	dc, ac     [4]*jpegHuffman
+	mcusX      int
+	mcusY      int
+}
+
+// progressiveJPEG rewrites baseline, a single-scan baseline JPEG such as
+// image/jpeg writes, as a progressive JPEG with the same coefficients, so
+// that the decoded pixels are unchanged. The DC coefficients come first,
+// for a coarse preview, then each component's AC coefficients in the
+// bands of progressiveBands. The Huffman tables are kept: spectral
+// selection without successive approximation uses the baseline symbols.
+func progressiveJPEG(baseline []byte) ([]byte, error) {
+	f, scan, err := readBaselineJPEG(baseline)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.decodeScan(scan); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(baseline)+len(baseline)/8)
+	out = append(out, 0xff, 0xd8)
+	out = append(out, f.tables...)
+	out = append(out, 0xff, 0xc2)
+	out = append(out, f.sof...)
+	out = f.writeDCScan(out)
+	for _, c := range f.components {
+		for _, band := range progressiveBands {
+			out = f.writeACScan(out, c, band[0], band[1])
+		}
+	}
+	return append(out, 0xff, 0xd9), nil
+}
+
+// readBaselineJPEG parses the segments of data up to its scan and returns
+// the entropy-coded data that follows the scan header.
+func readBaselineJPEG(data []byte) (*jpegFrame, []byte, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, nil, ErrInvalidJPEG
+	}
+	f := &jpegFrame{}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return nil, nil, ErrInvalidJPEG
+		}
+		marker := data[i+1]
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) {
+			return nil, nil, ErrInvalidJPEG
+		}
+		seg := data[i+4 : end]
+		switch {
+		case marker == 0xc0:
+			if err := f.readFrame(seg); err != nil {
+				return nil, nil, err
+			}
+		case marker == 0xc4:
+			if err := f.readHuffman(seg); err != nil {
+				return nil, nil, err
+			}
+			f.tables = append(f.tables, data[i:end]...)
+		case marker == 0xda:
+			if err := f.readScanHeader(seg); err != nil {
+				return nil, nil, err
+			}
+			return f, data[end:], nil
+		case marker == 0xdb || marker >= 0xe0 && marker <= 0xef || marker == 0xfe:
+			f.tables = append(f.tables, data[i:end]...)
+		default:
+			// Other frame types, restart intervals and the like are not
+			// written by image/jpeg.
+			return nil, nil, ErrInvalidJPEG
+		}
+		i = end
+	}
+	return nil, nil, ErrInvalidJPEG
+}
+
+func (f *jpegFrame) readFrame(seg []byte) error {
+	if len(seg) < 6 || seg[0] != 8 {
+		return ErrInvalidJPEG
+	}
+	height := int(binary.BigEndian.Uint16(seg[1:]))
+	width := int(binary.BigEndian.Uint16(seg[3:]))
+	n := int(seg[5])
+	if width == 0 || height == 0 || n == 0 || n > 4 || len(seg) != 6+3*n {
+		return ErrInvalidJPEG
+	}
+	f.sof = append(binary.BigEndian.AppendUint16(nil, uint16(len(seg)+2)), seg...)
+	var hmax, vmax int
+	for j := 0; j < n; j++ {
+		c := &jpegComponent{id: seg[6+3*j], h: seg[7+3*j] >> 4, v: seg[7+3*j] & 0x0f}
+		if c.h < 1 || c.h > 4 || c.v < 1 || c.v > 4 {
+			return ErrInvalidJPEG
+		}
+		hmax = max(hmax, int(c.h))
+		vmax = max(vmax, int(c.v))
+		f.components = append(f.components, c)
+	}
+	f.mcusX = (width + 8*hmax - 1) / (8 * hmax)
+	f.mcusY = (height + 8*vmax - 1) / (8 * vmax)
+	for _, c := range f.components {
+		cw := (width*int(c.h) + hmax - 1) / hmax
+		ch := (height*int(c.v) + vmax - 1) / vmax
+		c.bw = (cw + 7) / 8
+		c.bh = (ch + 7) / 8
+		c.stride = f.mcusX * int(c.h)
+		c.blocks = make([][64]int32, c.stride*f.mcusY*int(c.v))
+	}
+	return nil
+}
+
+func (f *jpegFrame) readHuffman(seg []byte) error {
+	for len(seg) > 0 {
+		if len(seg) < 17 {
+			return ErrInvalidJPEG
+		}
+		class, id := seg[0]>>4, seg[0]&0x0f
+		if class > 1 || id > 3 {
+			return ErrInvalidJPEG
+		}
+		n := 0
+		for _, c := range seg[1:17] {
+			n += int(c)
+		}
+		if n > 256 || len(seg) < 17+n {
+			return ErrInvalidJPEG
+		}
+		h := newJPEGHuffman(seg[1:17], seg[17:17+n])
+		if class == 0 {
+			f.dc[id] = h
+		} else {
+			f.ac[id] = h
+		}
+		seg = seg[17+n:]
+	}
+	return nil
+}
+
+// readScanHeader reads the table selectors of the single baseline scan,
+// which must cover every component.
+func (f *jpegFrame) readScanHeader(seg []byte) error {
+	if len(f.components) == 0 || len(seg) < 1 {
+		return ErrInvalidJPEG
+	}
+	n := int(seg[0])
+	if n != len(f.components) || len(seg) != 4+2*n || seg[1+2*n] != 0 || seg[2+2*n] != 63 || seg[3+2*n] != 0 {
+		return ErrInvalidJPEG
+	}
+	for j, c := range f.components {
+		if seg[1+2*j] != c.id {
+			return ErrInvalidJPEG
+		}
+		c.td, c.ta = seg[2+2*j]>>4, seg[2+2*j]&0x0f
+		if c.td > 3 || c.ta > 3 || f.dc[c.td] == nil || f.ac[c.ta] == nil {
+			return ErrInvalidJPEG
+		}
+	}
+	return nil
+}
+
+// eachBlock calls fn with every block of a scan of comps in the order they
+// are coded: MCU by MCU when the scan interleaves components, and in
+// raster order over the blocks covering a lone component.
+func (f *jpegFrame) eachBlock(comps []*jpegComponent, fn func(c *jpegComponent, b *[64]int32) error) error {
+	if len(comps) == 1 {
+		c := comps[0]
+		for y := 0; y < c.bh; y++ {
+			for x := 0; x < c.bw; x++ {
+				if err := fn(c, &c.blocks[y*c.stride+x]); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	for my := 0; my < f.mcusY; my++ {
+		for mx := 0; mx < f.mcusX; mx++ {
+			for _, c := range comps {
+				for v := 0; v < int(c.v); v++ {
+					for h := 0; h < int(c.h); h++ {
+						i := (my*int(c.v)+v)*c.stride + mx*int(c.h) + h
+						if err := fn(c, &c.blocks[i]); err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// decodeScan reads the coefficients of every block, in zig-zag order.
+func (f *jpegFrame) decodeScan(data []byte) error {
+	r := &jpegBitReader{data: data}
+	pred := make(map[*jpegComponent]int32, len(f.components))
+	return f.eachBlock(f.components, func(c *jpegComponent, b *[64]int32) error {
+		s, err := r.decode(f.dc[c.td])
+		if err != nil {
+			return err
+		}
+		diff, err := r.receive(s)
+		if err != nil {
+			return err
+		}
+		pred[c] += diff
+		b[0] = pred[c]
+		for k := 1; k < 64; k++ {
+			rs, err := r.decode(f.ac[c.ta])
+			if err != nil {
+				return err
+			}
+			run, size := int(rs>>4), rs&0x0f
+			if size == 0 {
+				if run != 15 {
+					break
+				}
+				k += 15
+				continue
+			}
+			k += run
+			if k > 63 {
+				return ErrInvalidJPEG
+			}
+			if b[k], err = r.receive(size); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (f *jpegFrame) writeDCScan(out []byte) []byte {
+	header := []byte{byte(len(f.components))}
+	for _, c := range f.components {
+		header = append(header, c.id, c.td<<4)
+	}
+	out = appendScanHeader(out, append(header, 0, 0, 0))
+
+	w := &jpegBitWriter{out: out}
+	pred := make(map[*jpegComponent]int32, len(f.components))
+	f.eachBlock(f.components, func(c *jpegComponent, b *[64]int32) error {
+		w.writeValue(f.dc[c.td], 0, b[0]-pred[c])
+		pred[c] = b[0]
+		return nil
+	})
+	return w.flush()
+}
+
+func (f *jpegFrame) writeACScan(out []byte, c *jpegComponent, ss, se int) []byte {
+	out = appendScanHeader(out, []byte{1, c.id, c.ta, byte(ss), byte(se), 0})
+
+	w := &jpegBitWriter{out: out}
+	h := f.ac[c.ta]
+	f.eachBlock([]*jpegComponent{c}, func(_ *jpegComponent, b *[64]int32) error {
+		run := 0
+		for k := ss; k <= se; k++ {
+			if b[k] == 0 {
+				run++
+				continue
+			}
+			for ; run >= 16; run -= 16 {
+				w.writeSymbol(h, 0xf0)
+			}
+			w.writeValue(h, byte(run<<4), b[k])
+			run = 0
+		}
+		if run > 0 {
+			// An end-of-band run of one block.
+			w.writeSymbol(h, 0x00)
+		}
+		return nil
+	})
+	return w.flush()
+}
+
+func appendScanHeader(out, header []byte) []byte {
+	out = append(out, 0xff, 0xda)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(header)+2))
+	return append(out, header...)
+}
+
+type jpegBitReader struct {
+	data []byte
+	pos  int
+	acc  byte
+	n    uint
+}
+
+func (r *jpegBitReader) bit() (int32, error) {
+	if r.n == 0 {
+		if r.pos >= len(r.data) {
+			return 0, ErrInvalidJPEG
+		}
+		b := r.data[r.pos]
+		r.pos++
+		if b == 0xff {
+			// A stuffed zero follows data bytes of 0xff; anything else is a
+			// marker ending the scan early.
+			if r.pos >= len(r.data) || r.data[r.pos] != 0 {
+				return 0, ErrInvalidJPEG
+			}
+			r.pos++
+		}
+		r.acc, r.n = b, 8
+	}
+	r.n--
+	return int32(r.acc>>r.n) & 1, nil
+}
+
+func (r *jpegBitReader) decode(h *jpegHuffman) (byte, error) {
+	code := int32(0)
+	for l := 1; l <= 16; l++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		code = code<<1 | b
+		if code <= h.maxCode[l] {
+			return h.values[h.valPtr[l]+code-h.minCode[l]], nil
+		}
+	}
+	return 0, ErrInvalidJPEG
+}
+
+// receive reads a size-bit magnitude and extends it to its signed value.
+func (r *jpegBitReader) receive(size byte) (int32, error) {
+	if size > 15 {
+		return 0, ErrInvalidJPEG
+	}
+	v := int32(0)
+	for i := byte(0); i < size; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	if size > 0 && v < 1<<(size-1) {
+		v += -1<<size + 1
+	}
+	return v, nil
+}
+
+type jpegBitWriter struct {
+	out []byte
+	acc uint32
+	n   uint
+}
+
+func (w *jpegBitWriter) write(v uint32, n uint) {
+	for n > 0 {
+		take := min(n, 8-w.n)
+		n -= take
+		w.acc = w.acc<<take | (v>>n)&(1<<take-1)
+		w.n += take
+		if w.n == 8 {
+			b := byte(w.acc)
+			w.out = append(w.out, b)
+			if b == 0xff {
+				w.out = append(w.out, 0)
+			}
+			w.acc, w.n = 0, 0
+		}
+	}
+}
+
+func (w *jpegBitWriter) writeSymbol(h *jpegHuffman, sym byte) {
+	w.write(uint32(h.codes[sym]), uint(h.sizes[sym]))
+}
+
+// writeValue writes the symbol combining prefix, a run for AC
+// coefficients, with the size of v, followed by v's magnitude bits.
+func (w *jpegBitWriter) writeValue(h *jpegHuffman, prefix byte, v int32) {
+	a := v
+	if a < 0 {
+		a = -a
+		v--
+	}
+	size := uint(bits.Len32(uint32(a)))
+	w.writeSymbol(h, prefix|byte(size))
+	w.write(uint32(v), size)
+}
+
+// flush pads the last byte with one bits.
+func (w *jpegBitWriter) flush() []byte {
+	if w.n > 0 {
+		w.write(1<<(8-w.n)-1, 8-w.n)
+	}
+	return w.out
+}
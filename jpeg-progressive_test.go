@@ -0,0 +1,92 @@
+package asset_delivery
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+func TestProgressiveJPEG(t *testing.T) {
+	cases := []struct {
+		Name string
+		Img  func(w, h int) image.Image
+	}{
+		{"colour", func(w, h int) image.Image {
+			img := image.NewNRGBA(image.Rect(0, 0, w, h))
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					img.Set(x, y, color.NRGBA{R: uint8(x * 7), G: uint8(y * 5), B: uint8(x ^ y), A: 255})
+				}
+			}
+			return img
+		}},
+		{"gray", func(w, h int) image.Image {
+			img := image.NewGray(image.Rect(0, 0, w, h))
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					img.SetGray(x, y, color.Gray{Y: uint8(x*3 + y*11)})
+				}
+			}
+			return img
+		}},
+	}
+	for _, c := range cases {
+		for _, size := range []image.Point{{1, 1}, {17, 9}, {64, 64}, {333, 121}} {
+			t.Run(c.Name+"/"+size.String(), func(t *testing.T) {
+				var baseline bytes.Buffer
+				if err := jpeg.Encode(&baseline, c.Img(size.X, size.Y), &jpeg.Options{Quality: 90}); err != nil {
+					t.Fatal(err)
+				}
+				progressive, err := progressiveJPEG(baseline.Bytes())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Contains(progressive, []byte{0xff, 0xc2}) || bytes.Contains(progressive, []byte{0xff, 0xc0}) {
+					t.Fatal("expected a progressive frame header only")
+				}
+
+				want, err := jpeg.Decode(bytes.NewReader(baseline.Bytes()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := jpeg.Decode(bytes.NewReader(progressive))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Bounds() != want.Bounds() {
+					t.Fatalf("expected bounds %v, got %v", want.Bounds(), got.Bounds())
+				}
+				for y := 0; y < size.Y; y++ {
+					for x := 0; x < size.X; x++ {
+						if got.At(x, y) != want.At(x, y) {
+							t.Fatalf("expected %v at %d,%d, got %v", want.At(x, y), x, y, got.At(x, y))
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestProgressiveJPEG_RejectsOtherData(t *testing.T) {
+	var baseline bytes.Buffer
+	if err := jpeg.Encode(&baseline, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	progressive, err := progressiveJPEG(baseline.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"empty":       nil,
+		"png":         []byte("\x89PNG\r\n\x1a\n"),
+		"progressive": progressive,
+		"truncated":   baseline.Bytes()[:baseline.Len()-8],
+	} {
+		if _, err := progressiveJPEG(data); err != ErrInvalidJPEG {
+			t.Errorf("%s: expected ErrInvalidJPEG, got %v", name, err)
+		}
+	}
+}
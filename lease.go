@@ -0,0 +1,92 @@
+package asset_delivery
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var ErrLeaseHeld = errors.New("lease held")
+
+// DefaultLeaseTTL is how long a lease is honoured without being released.
+// It should comfortably exceed the time a resize takes, so that a lease is
+// only ever taken over from a worker that died holding it.
+const DefaultLeaseTTL = 2 * time.Minute
+
+// leaseSuffix is appended to an object key to name its lease marker.
+const leaseSuffix = ".lease"
+
+// Leaser is optionally implemented by a FileSystem to let one worker at a
+// time process a given object key, across instances.
+type Leaser interface {
+	// Lease takes the lease on key for ttl. It fails with ErrLeaseHeld when
+	// another holder's lease has not expired. release gives the lease up,
+	// failing with ErrNoFile when it has already expired and been taken
+	// over, in which case the new holder keeps it.
+	Lease(key string, ttl time.Duration) (release func() error, err error)
+}
+
+// leaseMarker implements a lease as a marker object created with an
+// if-not-exists precondition. A marker past its TTL is taken over by
+// replacing it with a precondition on its version, so that of several
+// callers that find the same expired marker only one takes it over.
+// Releasing deletes the marker on the same condition, so that a holder
+// whose lease was taken over does not release its successor's.
+type leaseMarker struct {
+	// create writes the marker, failing with ErrLeaseHeld if it exists,
+	// and returns its version.
+	create func() (string, error)
+	// stat returns when the marker was written and a version that changes
+	// with every write, or ErrNoFile.
+	stat func() (time.Time, string, error)
+	// replace rewrites the marker if it is still at version, failing with
+	// ErrLeaseHeld if it has changed or gone, and returns the new version.
+	replace func(version string) (string, error)
+	// remove deletes the marker if it is still at version, failing with
+	// ErrNoFile if it has changed or gone.
+	remove func(version string) error
+}
+
+func (m leaseMarker) acquire(ttl time.Duration) (func() error, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		version, err := m.create()
+		if err == nil {
+			return m.release(version), nil
+		}
+		if err != ErrLeaseHeld {
+			return nil, err
+		}
+		t, version, err := m.stat()
+		if err == ErrNoFile {
+			// Released in the meantime.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if time.Since(t) < ttl {
+			return nil, ErrLeaseHeld
+		}
+		// The holder died without releasing it.
+		if version, err = m.replace(version); err != nil {
+			return nil, err
+		}
+		return m.release(version), nil
+	}
+	return nil, ErrLeaseHeld
+}
+
+func (m leaseMarker) release(version string) func() error {
+	return func() error {
+		return m.remove(version)
+	}
+}
+
+// leaseToken returns a random marker body, so that every write of a
+// marker has a distinct content-derived version such as an S3 ETag.
+func leaseToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,102 @@
+package asset_delivery
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// memLease is a marker in memory. onStat, when set, runs once after the
+// marker has been read by stat, to interleave another caller.
+type memLease struct {
+	exists  bool
+	version int
+	written time.Time
+	onStat  func()
+}
+
+func (m *memLease) write() {
+	m.exists = true
+	m.version++
+	m.written = time.Now()
+}
+
+func (m *memLease) marker() leaseMarker {
+	return leaseMarker{
+		create: func() (string, error) {
+			if m.exists {
+				return "", ErrLeaseHeld
+			}
+			m.write()
+			return strconv.Itoa(m.version), nil
+		},
+		stat: func() (time.Time, string, error) {
+			if !m.exists {
+				return time.Time{}, "", ErrNoFile
+			}
+			t, v := m.written, strconv.Itoa(m.version)
+			if f := m.onStat; f != nil {
+				m.onStat = nil
+				f()
+			}
+			return t, v, nil
+		},
+		replace: func(version string) (string, error) {
+			if !m.exists || strconv.Itoa(m.version) != version {
+				return "", ErrLeaseHeld
+			}
+			m.write()
+			return strconv.Itoa(m.version), nil
+		},
+		remove: func(version string) error {
+			if !m.exists || strconv.Itoa(m.version) != version {
+				return ErrNoFile
+			}
+			m.exists = false
+			return nil
+		},
+	}
+}
+
+func TestLeaseMarker_TakesOverExpired(t *testing.T) {
+	m := &memLease{exists: true, written: time.Now().Add(-time.Hour)}
+	if _, err := m.marker().acquire(time.Minute); err != nil {
+		t.Fatalf("expected an expired lease to be taken over, got %v", err)
+	}
+	if _, err := m.marker().acquire(time.Minute); err != ErrLeaseHeld {
+		t.Fatalf("expected the new lease to be held, got %v", err)
+	}
+}
+
+func TestLeaseMarker_OneTakeoverWins(t *testing.T) {
+	m := &memLease{exists: true, written: time.Now().Add(-time.Hour)}
+	// Another caller takes the expired lease over between this caller
+	// reading the marker and replacing it.
+	m.onStat = func() {
+		if _, err := m.marker().acquire(time.Minute); err != nil {
+			t.Fatalf("expected the first takeover to succeed, got %v", err)
+		}
+	}
+	if _, err := m.marker().acquire(time.Minute); err != ErrLeaseHeld {
+		t.Fatalf("expected the second takeover to fail with ErrLeaseHeld, got %v", err)
+	}
+}
+
+func TestLeaseMarker_ReleaseKeepsTakenOverLease(t *testing.T) {
+	m := &memLease{}
+	release, err := m.marker().acquire(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The holder overruns its TTL and another caller takes over.
+	m.written = time.Now().Add(-time.Hour)
+	if _, err := m.marker().acquire(time.Minute); err != nil {
+		t.Fatalf("expected an expired lease to be taken over, got %v", err)
+	}
+	if err := release(); err != ErrNoFile {
+		t.Fatalf("expected ErrNoFile releasing a taken over lease, got %v", err)
+	}
+	if !m.exists {
+		t.Fatal("expected the new holder's marker to be kept")
+	}
+}
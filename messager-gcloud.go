@@ -2,6 +2,8 @@ package asset_delivery
 
 import (
 	"context"
+	"net/http"
+	"sync"
 
 	"cloud.google.com/go/pubsub"
 	"github.com/monstercat/golib/logger"
@@ -10,6 +12,32 @@ import (
 type GCloudPubSub struct {
 	logger.Logger
 	*pubsub.Client
+
+	// Subscriptions maps a topic to the ID of the pull subscription that
+	// Subscribe consumes. Topics without an entry use the topic name.
+	Subscriptions map[string]string
+
+	// ReceiveSettings applies to every subscription started by Subscribe.
+	ReceiveSettings pubsub.ReceiveSettings
+
+	mu   sync.Mutex
+	subs map[*gcloudSubscription]struct{}
+}
+
+type gcloudSubscription struct {
+	p      *GCloudPubSub
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Unsubscribe stops receiving and waits for in-flight handlers to return.
+func (s *gcloudSubscription) Unsubscribe() {
+	s.cancel()
+	<-s.done
+
+	s.p.mu.Lock()
+	delete(s.p.subs, s)
+	s.p.mu.Unlock()
 }
 
 func (p *GCloudPubSub) Publish(subj string, data []byte) error {
@@ -26,4 +54,75 @@ func (p *GCloudPubSub) Publish(subj string, data []byte) error {
 		p.Log(logger.SeverityInfo, "Resize msg id: " + id)
 	}
 	return err
-}
\ No newline at end of file
+}
+
+// Subscribe acks every message once h returns.
+func (p *GCloudPubSub) Subscribe(subj string, h func([]byte)) (Subscription, error) {
+	return p.SubscribeAck(subj, func(data []byte) error {
+		h(data)
+		return nil
+	})
+}
+
+// SubscribeAck receives subj through its pull subscription. Messages are
+// acked when h returns nil or a 4xx error, which a redelivery would only
+// repeat, and nacked for 5xx errors, so redelivery and dead lettering
+// follow the subscription's policy exactly as they do for push deliveries.
+func (p *GCloudPubSub) SubscribeAck(subj string, h func([]byte) error) (Subscription, error) {
+	id := subj
+	if v, ok := p.Subscriptions[subj]; ok && v != "" {
+		id = v
+	}
+	sub := p.Client.Subscription(id)
+	sub.ReceiveSettings = p.ReceiveSettings
+
+	ok, err := sub.Exists(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, &SystemError{Detail: "Subscription " + id + " does not exist."}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &gcloudSubscription{p: p, cancel: cancel, done: make(chan struct{})}
+
+	p.mu.Lock()
+	if p.subs == nil {
+		p.subs = make(map[*gcloudSubscription]struct{})
+	}
+	p.subs[s] = struct{}{}
+	p.mu.Unlock()
+
+	go func() {
+		defer close(s.done)
+		err := sub.Receive(ctx, func(_ context.Context, msg *pubsub.Message) {
+			if err := h(msg.Data); err != nil && ErrorStatus(err) >= http.StatusInternalServerError {
+				msg.Nack()
+				return
+			}
+			msg.Ack()
+		})
+		if err != nil && p.Logger != nil {
+			p.Log(logger.SeverityError, "Stopped receiving from "+id+": "+err.Error())
+		}
+	}()
+	return s, nil
+}
+
+// Close stops every subscription and closes the underlying client.
+func (p *GCloudPubSub) Close() {
+	p.mu.Lock()
+	subs := make([]*gcloudSubscription, 0, len(p.subs))
+	for s := range p.subs {
+		subs = append(subs, s)
+	}
+	p.mu.Unlock()
+
+	for _, s := range subs {
+		s.Unsubscribe()
+	}
+	if err := p.Client.Close(); err != nil && p.Logger != nil {
+		p.Log(logger.SeverityError, "Could not close pubsub client: "+err.Error())
+	}
+}
@@ -0,0 +1,82 @@
+package asset_delivery
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func newTestGCloudPubSub(t *testing.T) (*GCloudPubSub, *pstest.Server) {
+	t.Helper()
+	srv := pstest.NewServer()
+	t.Cleanup(func() { srv.Close() })
+	conn, err := grpc.NewClient(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := pubsub.NewClient(context.Background(), "test", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &GCloudPubSub{Client: client}
+	t.Cleanup(p.Close)
+
+	topic, err := client.CreateTopic(context.Background(), ResizeTopic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CreateSubscription(context.Background(), ResizeTopic, pubsub.SubscriptionConfig{Topic: topic}); err != nil {
+		t.Fatal(err)
+	}
+	return p, srv
+}
+
+func TestGCloudPubSub_SubscribeAck(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Err   error
+		Acked bool
+	}{
+		{"success", nil, true},
+		{"param error", &ParamError{Param: "url", Detail: "Host is not permitted to perform this action."}, true},
+		{"system error", &SystemError{Detail: "An error occurred."}, false},
+		{"plain error", errors.New("unavailable"), false},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			p, srv := newTestGCloudPubSub(t)
+			handled := make(chan struct{}, 16)
+			sub, err := p.SubscribeAck(ResizeTopic, func([]byte) error {
+				handled <- struct{}{}
+				return c.Err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Publish(ResizeTopic, []byte("{}")); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-handled:
+			case <-time.After(5 * time.Second):
+				t.Fatal("message was not delivered")
+			}
+			sub.Unsubscribe()
+
+			msgs := srv.Messages()
+			if len(msgs) != 1 {
+				t.Fatalf("expected 1 message, got %d", len(msgs))
+			}
+			if acked := msgs[0].Acks > 0; acked != c.Acked {
+				t.Errorf("expected acked %v, got %d acks", c.Acked, msgs[0].Acks)
+			}
+		})
+	}
+}
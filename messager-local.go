@@ -0,0 +1,185 @@
+package asset_delivery
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/monstercat/golib/logger"
+)
+
+var (
+	ErrQueueFull      = errors.New("queue full")
+	ErrMessagerClosed = errors.New("messager closed")
+)
+
+const (
+	DefaultLocalMaxAttempts = 5
+	DefaultLocalRetryDelay  = time.Second
+)
+
+type localMessage struct {
+	sub     *localSubscription
+	data    []byte
+	attempt int
+}
+
+type localSubscription struct {
+	m    *LocalMessager
+	subj string
+	h    func([]byte) error
+}
+
+func (s *localSubscription) Unsubscribe() {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	subs := s.m.subs[s.subj]
+	for i, x := range subs {
+		if x == s {
+			s.m.subs[s.subj] = append(subs[:i:i], subs[i+1:]...)
+			return
+		}
+	}
+}
+
+// LocalMessager is an in-process Messager backed by a bounded queue and a
+// pool of worker goroutines. Each subscription receives its own copy of a
+// message. Handler errors follow the push worker's status rules (see
+// ErrorStatus): a 4xx drops the message, anything else is retried with
+// exponential backoff until MaxAttempts deliveries have been made.
+type LocalMessager struct {
+	logger.Logger
+
+	MaxAttempts int
+	RetryDelay  time.Duration
+
+	queue  chan localMessage
+	closed chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+
+	mu   sync.RWMutex
+	subs map[string][]*localSubscription
+}
+
+// NewLocalMessager starts workers goroutines consuming a queue holding at
+// most queueSize messages.
+func NewLocalMessager(queueSize, workers int) *LocalMessager {
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	m := &LocalMessager{
+		MaxAttempts: DefaultLocalMaxAttempts,
+		RetryDelay:  DefaultLocalRetryDelay,
+		queue:       make(chan localMessage, queueSize),
+		closed:      make(chan struct{}),
+		subs:        make(map[string][]*localSubscription),
+	}
+	m.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go m.work()
+	}
+	return m
+}
+
+func (m *LocalMessager) log(severity logger.Severity, msg string) {
+	if m.Logger != nil {
+		m.Log(severity, msg)
+	}
+}
+
+func (m *LocalMessager) work() {
+	defer m.wg.Done()
+	for {
+		select {
+		case <-m.closed:
+			return
+		case msg := <-m.queue:
+			m.deliver(msg)
+		}
+	}
+}
+
+func (m *LocalMessager) deliver(msg localMessage) {
+	err := msg.sub.h(msg.data)
+	if err == nil {
+		return
+	}
+	status := ErrorStatus(err)
+	if status < 500 {
+		m.log(logger.SeverityWarning, fmt.Sprintf("Dropping message on %s after %d attempt(s) (status %d): %s", msg.sub.subj, msg.attempt, status, err))
+		return
+	}
+	if msg.attempt >= m.MaxAttempts {
+		m.log(logger.SeverityError, fmt.Sprintf("Giving up on message on %s after %d attempt(s): %s", msg.sub.subj, msg.attempt, err))
+		return
+	}
+
+	delay := m.RetryDelay << (msg.attempt - 1)
+	msg.attempt++
+	time.AfterFunc(delay, func() {
+		if err := m.enqueue(msg); err != nil {
+			m.log(logger.SeverityError, fmt.Sprintf("Could not requeue message on %s: %s", msg.sub.subj, err))
+		}
+	})
+}
+
+func (m *LocalMessager) enqueue(msg localMessage) error {
+	select {
+	case <-m.closed:
+		return ErrMessagerClosed
+	default:
+	}
+	select {
+	case m.queue <- msg:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Publish queues data for every subscription on subj without blocking. It
+// returns ErrQueueFull when the queue has no room; messages on subjects
+// without subscriptions are discarded.
+func (m *LocalMessager) Publish(subj string, data []byte) error {
+	m.mu.RLock()
+	subs := m.subs[subj]
+	m.mu.RUnlock()
+
+	for _, s := range subs {
+		msg := localMessage{sub: s, data: append([]byte(nil), data...), attempt: 1}
+		if err := m.enqueue(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Subscribe treats every delivery as successful.
+func (m *LocalMessager) Subscribe(subj string, h func([]byte)) (Subscription, error) {
+	return m.SubscribeAck(subj, func(data []byte) error {
+		h(data)
+		return nil
+	})
+}
+
+func (m *LocalMessager) SubscribeAck(subj string, h func([]byte) error) (Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := &localSubscription{m: m, subj: subj, h: h}
+	m.subs[subj] = append(m.subs[subj], s)
+	return s, nil
+}
+
+// Close stops the workers after their current message. Queued messages
+// and pending retries are discarded.
+func (m *LocalMessager) Close() {
+	m.once.Do(func() {
+		close(m.closed)
+	})
+	m.wg.Wait()
+}
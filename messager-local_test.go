@@ -0,0 +1,120 @@
+package asset_delivery
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLocalMessager_Delivers(t *testing.T) {
+	m := NewLocalMessager(8, 2)
+	defer m.Close()
+
+	var got atomic.Value
+	if _, err := m.Subscribe("topic", func(b []byte) { got.Store(string(b)) }); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Publish("topic", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return got.Load() == "hello" })
+}
+
+func TestLocalMessager_RetryRules(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Err      error
+		Attempts int32
+	}{
+		{"4xx is dropped", &ParamError{Param: "url"}, 1},
+		{"5xx is retried until MaxAttempts", &SystemError{Detail: "boom"}, 3},
+		{"untyped error is retried", errors.New("boom"), 3},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			m := NewLocalMessager(8, 1)
+			m.MaxAttempts = 3
+			m.RetryDelay = time.Millisecond
+
+			var calls int32
+			_, err := m.SubscribeAck("topic", func([]byte) error {
+				atomic.AddInt32(&calls, 1)
+				return c.Err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Publish("topic", nil); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, func() bool { return atomic.LoadInt32(&calls) >= c.Attempts })
+			// Give a would-be extra retry the chance to show up.
+			time.Sleep(20 * time.Millisecond)
+			m.Close()
+			if n := atomic.LoadInt32(&calls); n != c.Attempts {
+				t.Fatalf("expected %d attempts, got %d", c.Attempts, n)
+			}
+		})
+	}
+}
+
+func TestLocalMessager_RetrySucceeds(t *testing.T) {
+	m := NewLocalMessager(8, 1)
+	defer m.Close()
+	m.RetryDelay = time.Millisecond
+
+	var calls int32
+	m.SubscribeAck("topic", func([]byte) error {
+		if atomic.AddInt32(&calls, 1) < 2 {
+			return &SystemError{Detail: "transient"}
+		}
+		return nil
+	})
+	m.Publish("topic", nil)
+	waitFor(t, func() bool { return atomic.LoadInt32(&calls) == 2 })
+}
+
+func TestLocalMessager_QueueFull(t *testing.T) {
+	m := NewLocalMessager(1, 1)
+	defer m.Close()
+
+	block := make(chan struct{})
+	started := make(chan struct{}, 1)
+	m.Subscribe("topic", func([]byte) {
+		started <- struct{}{}
+		<-block
+	})
+	defer close(block)
+
+	if err := m.Publish("topic", nil); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if err := m.Publish("topic", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Publish("topic", nil); err != ErrQueueFull {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+}
+
+func TestLocalMessager_PublishAfterClose(t *testing.T) {
+	m := NewLocalMessager(1, 1)
+	m.Subscribe("topic", func([]byte) {})
+	m.Close()
+	if err := m.Publish("topic", nil); err != ErrMessagerClosed {
+		t.Fatalf("expected ErrMessagerClosed, got %v", err)
+	}
+}
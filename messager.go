@@ -16,4 +16,11 @@ type Subscriber interface {
 
 type Publisher interface {
 	Publish(subj string, data []byte) error
-}
\ No newline at end of file
+}
+
+// AckSubscriber is implemented by Messagers whose handlers decide whether a
+// message is acknowledged. A nil error acks the message; any other error
+// hands it back for redelivery.
+type AckSubscriber interface {
+	SubscribeAck(subj string, h func([]byte) error) (Subscription, error)
+}
@@ -0,0 +1,59 @@
+package asset_delivery
+
+import (
+	"strconv"
+	"strings"
+)
+
+// EncodingAuto is the `encoding=` value that asks the delivery server to
+// pick the output format from the request's Accept header.
+const EncodingAuto = "auto"
+
+// AutoEncodings lists, in order of preference, the formats encoding=auto
+// may choose. A format is only chosen when the client names its MIME type
+// explicitly; wildcards such as image/* are sent by browsers that cannot
+// display every image type, so they do not count.
+var AutoEncodings = []string{"webp"}
+
+// NegotiateEncoding returns the encoding to use for encoding=auto given
+// the request's Accept header. It returns "" when no format in
+// AutoEncodings is acceptable, in which case the source format is kept.
+func NegotiateEncoding(accept string) string {
+	accepted := parseAccept(accept)
+	best, bestQ := "", 0.0
+	for _, name := range AutoEncodings {
+		c, ok := CodecByName(name)
+		if !ok || c.Encode == nil {
+			continue
+		}
+		if q := accepted[c.MIMEType]; q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// parseAccept maps each media type in an Accept header to its quality.
+// Malformed qualities count as 1, as most servers treat them.
+func parseAccept(accept string) map[string]float64 {
+	m := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		typ := strings.ToLower(strings.TrimSpace(params[0]))
+		if typ == "" {
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+			if !ok || strings.TrimSpace(k) != "q" {
+				continue
+			}
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil && f >= 0 && f <= 1 {
+				q = f
+			}
+		}
+		m[typ] = q
+	}
+	return m
+}
@@ -0,0 +1,25 @@
+package asset_delivery
+
+import "testing"
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Accept string
+		Want   string
+	}{
+		{"empty", "", ""},
+		{"chrome", "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8", "webp"},
+		{"safari without webp", "image/png,image/svg+xml,image/*;q=0.8,video/*;q=0.8,*/*;q=0.5", ""},
+		{"wildcards only", "*/*", ""},
+		{"webp refused", "image/webp;q=0, */*", ""},
+		{"case and spacing", " Image/WebP ; q=0.5 ", "webp"},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			if got := NegotiateEncoding(c.Accept); got != c.Want {
+				t.Fatalf("expected %q, got %q", c.Want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package asset_delivery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Preset is a named set of query parameters, e.g. {"width": "1200",
+// "fit": "cover"}. Parameters given explicitly in a request override it.
+type Preset map[string]string
+
+// PresetOnlyParams are the query parameters allowed next to `preset` when
+// a server only accepts presets. None of them change the transformation;
+// `v` only selects which version of the source it applies to. `force` is
+// left out, since it would let any client skip the pending and failure
+// throttles.
+var PresetOnlyParams = []string{"preset", "url", "v", SignatureParam, KeyIDParam, ExpiresParam}
+
+var presets = struct {
+	sync.RWMutex
+	byName map[string]Preset
+}{byName: make(map[string]Preset)}
+
+// RegisterPreset validates p and makes it available as `preset=name`,
+// replacing any preset of the same name.
+func RegisterPreset(name string, p Preset) error {
+	if name == "" {
+		return fmt.Errorf("preset name is empty")
+	}
+	if _, ok := p["url"]; ok {
+		return fmt.Errorf("preset %q: url cannot be preset", name)
+	}
+	if _, ok := p["preset"]; ok {
+		return fmt.Errorf("preset %q: presets cannot be nested", name)
+	}
+	q := url.Values{"url": {"https://preset.test/image.png"}}
+	for k, v := range p {
+		q.Set(k, v)
+	}
+	if _, err := NewResizeOptionsFromQuery(q); err != nil {
+		return fmt.Errorf("preset %q: %s", name, err)
+	}
+
+	presets.Lock()
+	defer presets.Unlock()
+	presets.byName[name] = p
+	return nil
+}
+
+// PresetByName looks up a registered preset.
+func PresetByName(name string) (Preset, bool) {
+	presets.RLock()
+	defer presets.RUnlock()
+	p, ok := presets.byName[name]
+	return p, ok
+}
+
+// PresetNames lists the registered presets, sorted.
+func PresetNames() []string {
+	presets.RLock()
+	defer presets.RUnlock()
+	names := make([]string, 0, len(presets.byName))
+	for name := range presets.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadPresets registers the presets in a JSON file mapping preset names
+// to query parameters:
+//
+//	{"cover-large": {"width": 1200, "height": 630, "fit": "cover", "encoding": "webp", "quality": 85}}
+func LoadPresets(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file map[string]map[string]any
+	if err := json.Unmarshal(b, &file); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for name, params := range file {
+		p := make(Preset, len(params))
+		for k, v := range params {
+			switch v := v.(type) {
+			case string:
+				p[k] = v
+			case float64:
+				p[k] = strconv.FormatFloat(v, 'f', -1, 64)
+			case bool:
+				p[k] = strconv.FormatBool(v)
+			default:
+				return fmt.Errorf("%s: preset %q: %s must be a string, number or boolean", path, name, k)
+			}
+		}
+		if err := RegisterPreset(name, p); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// expandPreset returns m with the named preset's parameters filled in
+// where m does not set them.
+func expandPreset(name string, m map[string][]string) (map[string][]string, error) {
+	p, ok := PresetByName(name)
+	if !ok {
+		return nil, &ParamError{Param: "preset", Detail: "Unknown preset."}
+	}
+	out := make(map[string][]string, len(m)+len(p))
+	for k, v := range p {
+		out[k] = []string{v}
+	}
+	for k, v := range m {
+		if k != "preset" {
+			out[k] = v
+		}
+	}
+	return out, nil
+}
+
+// CheckPresetOnly rejects queries that choose a variant with anything but
+// `preset`.
+func CheckPresetOnly(q url.Values) error {
+	if strings.TrimSpace(q.Get("preset")) == "" {
+		return &ParamError{Param: "preset", Detail: "A preset is required."}
+	}
+	for k := range q {
+		allowed := false
+		for _, p := range PresetOnlyParams {
+			allowed = allowed || k == p
+		}
+		if !allowed {
+			return &ParamError{Param: k, Detail: "Only presets may be used to choose a variant."}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package asset_delivery
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func unregisterPresets(t *testing.T, names ...string) {
+	t.Cleanup(func() {
+		presets.Lock()
+		defer presets.Unlock()
+		for _, name := range names {
+			delete(presets.byName, name)
+		}
+	})
+}
+
+func TestLoadPresets(t *testing.T) {
+	unregisterPresets(t, "cover-large", "thumb")
+	path := filepath.Join(t.TempDir(), "presets.json")
+	err := os.WriteFile(path, []byte(`{
+		"cover-large": {"width": 1200, "height": 630, "fit": "cover", "encoding": "webp", "quality": 85},
+		"thumb": {"width": "64", "lossless": true}
+	}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadPresets(path); err != nil {
+		t.Fatal(err)
+	}
+
+	q, _ := url.ParseQuery("url=https://a/b.png&preset=cover-large&quality=60")
+	opts, err := NewResizeOptionsFromQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Width != 1200 || opts.Height != 630 || opts.Fit != FitCover || opts.Encoding != "webp" {
+		t.Fatalf("expected the preset to be expanded, got %+v", opts.ResizeOptions)
+	}
+	if opts.Quality != 60 {
+		t.Fatalf("expected explicit parameters to override the preset, got quality %d", opts.Quality)
+	}
+
+	q, _ = url.ParseQuery("url=https://a/b.png&preset=thumb")
+	if opts, err = NewResizeOptionsFromQuery(q); err != nil || opts.Width != 64 || !opts.Lossless {
+		t.Fatalf("expected the thumb preset, got %+v, %v", opts.ResizeOptions, err)
+	}
+}
+
+func TestLoadPresets_Invalid(t *testing.T) {
+	cases := map[string]string{
+		"bad value":   `{"p": {"fit": "squash"}}`,
+		"url":         `{"p": {"url": "https://a/b.png"}}`,
+		"nested":      `{"p": {"preset": "q"}}`,
+		"object":      `{"p": {"width": {"px": 100}}}`,
+		"not presets": `[]`,
+	}
+	for name, body := range cases {
+		t.Run(name, func(t *testing.T) {
+			unregisterPresets(t, "p")
+			path := filepath.Join(t.TempDir(), "presets.json")
+			if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := LoadPresets(path); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestNewResizeOptionsFromQuery_UnknownPreset(t *testing.T) {
+	q, _ := url.ParseQuery("url=https://a/b.png&preset=missing")
+	_, err := NewResizeOptionsFromQuery(q)
+	if perr, ok := err.(*ParamError); !ok || perr.Param != "preset" {
+		t.Fatalf("expected a ParamError for preset, got %v", err)
+	}
+}
+
+func TestCheckPresetOnly(t *testing.T) {
+	cases := []struct {
+		Query string
+		Param string
+	}{
+		{"url=https://a/b.png&preset=thumb", ""},
+		{"url=https://a/b.png&preset=thumb&v=2&kid=k&sig=s&expires=1", ""},
+		{"url=https://a/b.png&preset=thumb&force", "force"},
+		{"url=https://a/b.png", "preset"},
+		{"url=https://a/b.png&preset=thumb&width=100", "width"},
+		{"url=https://a/b.png&preset=thumb&encoding=png", "encoding"},
+	}
+	for _, c := range cases {
+		q, _ := url.ParseQuery(c.Query)
+		err := CheckPresetOnly(q)
+		if c.Param == "" {
+			if err != nil {
+				t.Errorf("%s: expected no error, got %v", c.Query, err)
+			}
+			continue
+		}
+		if perr, ok := err.(*ParamError); !ok || perr.Param != c.Param {
+			t.Errorf("%s: expected a ParamError for %q, got %v", c.Query, c.Param, err)
+		}
+	}
+}
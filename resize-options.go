@@ -4,6 +4,7 @@ import (
 	"crypto/sha1"
 	"errors"
 	"fmt"
+	"math"
 	"net/url"
 	"path/filepath"
 	"strconv"
@@ -12,41 +13,188 @@ import (
 
 const MaxImageDimension = 4096
 
+// FallbackEncoding is the output extension for sources in formats that can
+// be read but not written, such as TIFF and SVG, when no encoding is
+// requested.
+const FallbackEncoding = ".png"
+
+// Fit controls how an image is resized when both Width and Height are
+// requested. With a single dimension every fit except FitInside keeps the
+// aspect ratio and derives the other dimension.
+type Fit string
+
+const (
+	// FitScale keeps the aspect ratio and fits the image within the box.
+	FitScale Fit = "scale"
+	// FitCover fills the box exactly, cropping whatever overflows.
+	FitCover Fit = "cover"
+	// FitContain fits the image within the box and pads the remainder with
+	// transparency so the output is exactly the box size.
+	FitContain Fit = "contain"
+	// FitFill stretches the image to the box, ignoring the aspect ratio.
+	FitFill Fit = "fill"
+	// FitInside behaves like FitScale but never enlarges the image.
+	FitInside Fit = "inside"
+)
+
+func (f Fit) Valid() bool {
+	switch f {
+	case FitScale, FitCover, FitContain, FitFill, FitInside:
+		return true
+	}
+	return false
+}
+
+// Gravity picks the part of the image kept by a FitCover crop, or where a
+// FitContain image sits within its padding.
+type Gravity string
+
+const (
+	GravityCenter    Gravity = "center"
+	GravityNorth     Gravity = "north"
+	GravitySouth     Gravity = "south"
+	GravityEast      Gravity = "east"
+	GravityWest      Gravity = "west"
+	GravityNorthEast Gravity = "north-east"
+	GravityNorthWest Gravity = "north-west"
+	GravitySouthEast Gravity = "south-east"
+	GravitySouthWest Gravity = "south-west"
+
+	// GravitySmart keeps the region with the most visual detail; see
+	// SmartCrop. Without a crop it behaves like GravityCenter.
+	GravitySmart Gravity = "smart"
+)
+
+// gravityAnchors maps each Gravity to the fraction of the free space that
+// goes before the kept region, horizontally and vertically.
+var gravityAnchors = map[Gravity][2]float64{
+	GravityCenter:    {0.5, 0.5},
+	GravityNorth:     {0.5, 0},
+	GravitySouth:     {0.5, 1},
+	GravityEast:      {1, 0.5},
+	GravityWest:      {0, 0.5},
+	GravityNorthEast: {1, 0},
+	GravityNorthWest: {0, 0},
+	GravitySouthEast: {1, 1},
+	GravitySouthWest: {0, 1},
+}
+
+func (g Gravity) Valid() bool {
+	_, ok := gravityAnchors[g]
+	return ok || g == GravitySmart
+}
+
+// FocalPoint is a point of interest in the source image, as fractions of
+// its width and height. A FitCover crop is centred on it as far as the
+// image bounds allow.
+type FocalPoint struct {
+	X float64
+	Y float64
+}
+
+// FocalPointPrecision is the number of decimals a focal point is rounded
+// to when parsed, so that nearby points share one variant key.
+const FocalPointPrecision = 3
+
+func (p FocalPoint) String() string {
+	return strconv.FormatFloat(p.X, 'f', -1, 64) + "_" + strconv.FormatFloat(p.Y, 'f', -1, 64)
+}
+
 type ResizeOptions struct {
 	Width        uint
+	Height       uint
+	Fit          Fit
+	Gravity      Gravity
+	Focus        *FocalPoint
 	Location     string
 	HashSum      string
 	Encoding     string
 	Prefix       string
 	CacheControl string
+	// Version is the `v` cache-busting parameter. It is folded into
+	// HashSum, so each version of a source gets its own variants.
+	Version string
+	// RecordSource asks the resize to record the version of the source in
+	// its sidecar, for the delivery server's revalidation.
+	RecordSource bool
+	EncodeOptions
 }
 
+// maxVersionLength caps the `v` parameter.
+const maxVersionLength = 64
+
 type ResizeOptionsProcessed struct {
 	ResizeOptions
 	URL   *url.URL
 	Force bool
+	// Sync asks the delivery server to resize a missing variant inline
+	// rather than only publish a resize request.
+	Sync bool
 }
 
 func (opts *ResizeOptions) PopulateHash() {
 	hash := sha1.New()
 	hash.Write([]byte(opts.Location))
+	if opts.Version != "" {
+		// Without a version the hash, and so every existing key, is
+		// unchanged.
+		hash.Write([]byte("\x00v=" + opts.Version))
+	}
 	sum := hash.Sum(nil)
 	opts.HashSum = fmt.Sprintf("%x", sum)
 }
 
 func (opts *ResizeOptions) ObjectKey() string {
-	return fmt.Sprintf("%s/%s/%d%s", opts.Prefix, opts.HashSum, opts.Width, opts.DesiredEncoding())
+	return fmt.Sprintf("%s/%s/%s%s", opts.Prefix, opts.HashSum, opts.variant(), opts.DesiredEncoding())
+}
+
+// SourceKey names the sidecar recording the version of the source, shared
+// by every variant of it.
+func (opts *ResizeOptions) SourceKey() string {
+	return fmt.Sprintf("%s/%s%s", opts.Prefix, opts.HashSum, sourceSuffix)
+}
+
+// variant names the transformation applied to the source so that different
+// outputs never share an object key. Width-only requests keep the plain
+// "{width}" form used before heights and fits existed.
+func (opts *ResizeOptions) variant() string {
+	var b strings.Builder
+	b.WriteString(strconv.FormatUint(uint64(opts.Width), 10))
+	if opts.Height > 0 {
+		b.WriteString("x" + strconv.FormatUint(uint64(opts.Height), 10))
+	}
+	if opts.Fit != "" && opts.Fit != FitScale {
+		b.WriteString("-" + string(opts.Fit))
+	}
+	if opts.Gravity != "" && opts.Gravity != GravityCenter {
+		b.WriteString("-g" + string(opts.Gravity))
+	}
+	if opts.Focus != nil {
+		b.WriteString("-f" + opts.Focus.String())
+	}
+	b.WriteString(opts.EncodeOptions.variant())
+	return b.String()
 }
 
 func (opts *ResizeOptions) DesiredEncoding() string {
 	if len(opts.Encoding) > 0 {
 		return "." + opts.Encoding
 	}
-	return filepath.Ext(opts.Location)
+	ext := filepath.Ext(opts.Location)
+	if c, ok := CodecByExtension(ext); ok && c.Encode == nil {
+		return FallbackEncoding
+	}
+	return ext
 }
 
 func NewResizeOptionsFromQuery(m map[string][]string) (ResizeOptionsProcessed, error) {
 	var opts ResizeOptionsProcessed
+	if xs, ok := m["preset"]; ok {
+		var err error
+		if m, err = expandPreset(strings.TrimSpace(xs[0]), m); err != nil {
+			return opts, err
+		}
+	}
 	if xs, ok := m["width"]; ok {
 		var err error
 		opts.Width, err = parseUint(xs[0])
@@ -57,6 +205,38 @@ func NewResizeOptionsFromQuery(m map[string][]string) (ResizeOptionsProcessed, e
 			return opts, &ParamError{Param: "width", Detail: "Expected a width greater than 0 and less than 4096."}
 		}
 	}
+	if xs, ok := m["height"]; ok {
+		var err error
+		opts.Height, err = parseUint(xs[0])
+		if err != nil {
+			return opts, &ParamError{Param: "height", Detail: "Invalid value."}
+		}
+		if opts.Height <= 0 || opts.Height > MaxImageDimension {
+			return opts, &ParamError{Param: "height", Detail: "Expected a height greater than 0 and less than 4096."}
+		}
+	}
+	if xs, ok := m["fit"]; ok {
+		opts.Fit = Fit(strings.ToLower(strings.TrimSpace(xs[0])))
+		if !opts.Fit.Valid() {
+			return opts, &ParamError{Param: "fit", Detail: "Expected one of scale, cover, contain, fill or inside."}
+		}
+	}
+	if xs, ok := m["gravity"]; ok {
+		opts.Gravity = Gravity(strings.ToLower(strings.TrimSpace(xs[0])))
+		if !opts.Gravity.Valid() {
+			return opts, &ParamError{Param: "gravity", Detail: "Expected center, north, south, east, west, north-east, north-west, south-east, south-west or smart."}
+		}
+	}
+	if xs, ok := m["focus"]; ok {
+		p, err := parseFocalPoint(xs[0])
+		if err != nil {
+			return opts, &ParamError{Param: "focus", Detail: "Expected x,y fractions between 0 and 1.", RootError: err}
+		}
+		if opts.Gravity != "" {
+			return opts, &ParamError{Param: "focus", Detail: "Use either gravity or focus, not both."}
+		}
+		opts.Focus = &p
+	}
 	if xs, ok := m["url"]; ok {
 		opts.Location = strings.TrimSpace(xs[0])
 		var err error
@@ -65,6 +245,12 @@ func NewResizeOptionsFromQuery(m map[string][]string) (ResizeOptionsProcessed, e
 			return opts, &ParamError{Param: "url", Detail: "Invalid URL provided.", RootError: err}
 		}
 	}
+	if xs, ok := m["v"]; ok {
+		opts.Version = strings.TrimSpace(xs[0])
+		if len(opts.Version) > maxVersionLength {
+			return opts, &ParamError{Param: "v", Detail: fmt.Sprintf("Expected at most %d characters.", maxVersionLength)}
+		}
+	}
 	if opts.Location == "" {
 		return opts, &ParamError{Param: "url", Detail: "Invalid (or missing) URL."}
 	} else {
@@ -73,9 +259,25 @@ func NewResizeOptionsFromQuery(m map[string][]string) (ResizeOptionsProcessed, e
 	if _, ok := m["force"]; ok {
 		opts.Force = true
 	}
+	if xs, ok := m["sync"]; ok {
+		v, err := parseFlag(xs[0])
+		if err != nil {
+			return opts, &ParamError{Param: "sync", Detail: "Expected true or false."}
+		}
+		opts.Sync = v
+	}
 	if xs, ok := m["encoding"]; ok {
-		opts.Encoding = strings.TrimSpace(xs[0])
-		// TODO validate encoding param, we'll let image encoder default for now
+		opts.Encoding = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(xs[0])), ".")
+		if opts.Encoding != "" && opts.Encoding != EncodingAuto && !CanEncode(opts.Encoding) {
+			return opts, &ParamError{
+				Param:     "encoding",
+				Detail:    fmt.Sprintf("Unsupported encoding. Expected auto or one of %s.", strings.Join(EncodingNames(), ", ")),
+				RootError: ErrFileNotHandled,
+			}
+		}
+	}
+	if err := parseEncodeOptions(m, &opts.EncodeOptions); err != nil {
+		return opts, err
 	}
 	if xs, ok := m["cache-control"]; ok {
 		opts.CacheControl = strings.TrimSpace(xs[0])
@@ -83,6 +285,26 @@ func NewResizeOptionsFromQuery(m map[string][]string) (ResizeOptionsProcessed, e
 	return opts, nil
 }
 
+func parseFocalPoint(str string) (FocalPoint, error) {
+	parts := strings.Split(str, ",")
+	if len(parts) != 2 {
+		return FocalPoint{}, errors.New("expected two comma separated values")
+	}
+	var xy [2]float64
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return FocalPoint{}, err
+		}
+		if !(v >= 0 && v <= 1) {
+			return FocalPoint{}, errors.New("value out of range")
+		}
+		scale := math.Pow10(FocalPointPrecision)
+		xy[i] = math.Round(v*scale) / scale
+	}
+	return FocalPoint{X: xy[0], Y: xy[1]}, nil
+}
+
 func parseUint(str string) (uint, error) {
 	size, err := strconv.ParseUint(str, 10, 32)
 	if err != nil {
@@ -93,8 +315,13 @@ func parseUint(str string) (uint, error) {
 
 type WriteInfo struct {
 	cacheControl string
+	contentType  string
 }
 
 func (i *WriteInfo) CacheControl() string {
 	return i.cacheControl
 }
+
+func (i *WriteInfo) ContentType() string {
+	return i.contentType
+}
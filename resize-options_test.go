@@ -0,0 +1,145 @@
+package asset_delivery
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNewResizeOptionsFromQuery(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Query string
+		Param string
+	}{
+		{"width only", "url=https://a/b.png&width=100", ""},
+		{"width and height", "url=https://a/b.png&width=100&height=50", ""},
+		{"fit is case insensitive", "url=https://a/b.png&width=100&height=50&fit=Cover", ""},
+		{"zero height", "url=https://a/b.png&height=0", "height"},
+		{"height too large", "url=https://a/b.png&height=5000", "height"},
+		{"bad height", "url=https://a/b.png&height=abc", "height"},
+		{"unknown fit", "url=https://a/b.png&width=100&fit=squash", "fit"},
+		{"gravity", "url=https://a/b.png&width=100&height=50&fit=cover&gravity=south-east", ""},
+		{"unknown gravity", "url=https://a/b.png&gravity=up", "gravity"},
+		{"focus", "url=https://a/b.png&width=100&height=50&fit=cover&focus=0.25,0.75", ""},
+		{"focus out of range", "url=https://a/b.png&focus=1.5,0", "focus"},
+		{"focus not a number", "url=https://a/b.png&focus=NaN,0", "focus"},
+		{"focus missing y", "url=https://a/b.png&focus=0.5", "focus"},
+		{"gravity and focus", "url=https://a/b.png&gravity=north&focus=0.5,0.5", "focus"},
+		{"quality", "url=https://a/b.png&quality=90", ""},
+		{"quality too low", "url=https://a/b.png&quality=0", "quality"},
+		{"quality too high", "url=https://a/b.png&quality=101", "quality"},
+		{"quality not a number", "url=https://a/b.png&quality=high", "quality"},
+		{"bare lossless", "url=https://a/b.png&lossless", ""},
+		{"bad lossless", "url=https://a/b.png&lossless=maybe", "lossless"},
+		{"progressive off", "url=https://a/b.png&progressive=false", ""},
+		{"progressive on", "url=https://a/b.png&progressive=1", ""},
+		{"progressive invalid", "url=https://a/b.png&progressive=maybe", "progressive"},
+		{"compression", "url=https://a/b.png&compression=best", ""},
+		{"unknown compression", "url=https://a/b.png&compression=ultra", "compression"},
+		{"keep-metadata", "url=https://a/b.png&keep-metadata", ""},
+		{"bad keep-metadata", "url=https://a/b.png&keep-metadata=sometimes", "keep-metadata"},
+		{"sync", "url=https://a/b.png&sync", ""},
+		{"version", "url=https://a/b.png&v=2024-06", ""},
+		{"version too long", "url=https://a/b.png&v=" + strings.Repeat("x", 65), "v"},
+		{"bad sync", "url=https://a/b.png&sync=later", "sync"},
+		{"encoding", "url=https://a/b.png&encoding=webp", ""},
+		{"encoding is case insensitive", "url=https://a/b.png&encoding=JPG", ""},
+		{"encoding with a leading dot", "url=https://a/b.png&encoding=.png", ""},
+		{"auto encoding", "url=https://a/b.png&encoding=auto", ""},
+		{"unsupported encoding", "url=https://a/b.png&encoding=tiff", "encoding"},
+		{"missing url", "width=100", "url"},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			q, err := url.ParseQuery(c.Query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = NewResizeOptionsFromQuery(q)
+			if c.Param == "" {
+				if err != nil {
+					t.Fatalf("expected no error, got %s", err)
+				}
+				return
+			}
+			perr, ok := err.(*ParamError)
+			if !ok {
+				t.Fatalf("expected a ParamError for %q, got %v", c.Param, err)
+			}
+			if perr.Param != c.Param {
+				t.Fatalf("expected a ParamError for %q, got %q", c.Param, perr.Param)
+			}
+		})
+	}
+}
+
+func TestNewResizeOptionsFromQuery_RoundsFocus(t *testing.T) {
+	cases := []struct {
+		Focus string
+		Want  string
+	}{
+		{"0.25,0.75", "0.25_0.75"},
+		{"0.123456789,0.5", "0.123_0.5"},
+		{"0.12349,0.99999", "0.123_1"},
+		{"0.0004,1", "0_1"},
+	}
+	for _, c := range cases {
+		q := url.Values{"url": {"https://a/b.png"}, "focus": {c.Focus}}
+		opts, err := NewResizeOptionsFromQuery(q)
+		if err != nil {
+			t.Fatalf("%s: %s", c.Focus, err)
+		}
+		if got := opts.Focus.String(); got != c.Want {
+			t.Errorf("%s: expected %s, got %s", c.Focus, c.Want, got)
+		}
+	}
+}
+
+func TestObjectKey(t *testing.T) {
+	cases := []struct {
+		Name string
+		Opts ResizeOptions
+		Want string
+	}{
+		{"width only keeps the legacy key", ResizeOptions{Width: 100, Encoding: "webp"}, "resized/hash/100.webp"},
+		{"explicit scale fit shares the default key", ResizeOptions{Width: 100, Fit: FitScale, Encoding: "webp"}, "resized/hash/100.webp"},
+		{"height", ResizeOptions{Width: 100, Height: 50, Encoding: "webp"}, "resized/hash/100x50.webp"},
+		{"height only", ResizeOptions{Height: 50, Encoding: "webp"}, "resized/hash/0x50.webp"},
+		{"fit", ResizeOptions{Width: 100, Height: 50, Fit: FitCover, Encoding: "webp"}, "resized/hash/100x50-cover.webp"},
+		{"gravity", ResizeOptions{Width: 100, Height: 50, Fit: FitCover, Gravity: GravityNorthEast, Encoding: "webp"}, "resized/hash/100x50-cover-gnorth-east.webp"},
+		{"center gravity shares the default key", ResizeOptions{Width: 100, Height: 50, Fit: FitCover, Gravity: GravityCenter, Encoding: "webp"}, "resized/hash/100x50-cover.webp"},
+		{"focus", ResizeOptions{Width: 100, Height: 50, Fit: FitCover, Focus: &FocalPoint{X: 0.25, Y: 0.5}, Encoding: "webp"}, "resized/hash/100x50-cover-f0.25_0.5.webp"},
+		{"default quality shares the default key", ResizeOptions{Width: 100, Encoding: "webp", EncodeOptions: EncodeOptions{Quality: DefaultQuality}}, "resized/hash/100.webp"},
+		{"quality", ResizeOptions{Width: 100, Encoding: "webp", EncodeOptions: EncodeOptions{Quality: 60}}, "resized/hash/100-q60.webp"},
+		{"lossless", ResizeOptions{Width: 100, Encoding: "webp", EncodeOptions: EncodeOptions{Lossless: true}}, "resized/hash/100-lossless.webp"},
+		{"progressive", ResizeOptions{Width: 100, Encoding: "jpg", EncodeOptions: EncodeOptions{Progressive: true}}, "resized/hash/100-progressive.jpg"},
+		{"compression", ResizeOptions{Width: 100, Encoding: "png", EncodeOptions: EncodeOptions{Compression: CompressionBest}}, "resized/hash/100-cbest.png"},
+		{"keep metadata", ResizeOptions{Width: 100, Encoding: "webp", EncodeOptions: EncodeOptions{KeepMetadata: true}}, "resized/hash/100-meta.webp"},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			c.Opts.Prefix = "resized"
+			c.Opts.HashSum = "hash"
+			if got := c.Opts.ObjectKey(); got != c.Want {
+				t.Fatalf("expected %q, got %q", c.Want, got)
+			}
+		})
+	}
+}
+
+func TestPopulateHash_Version(t *testing.T) {
+	legacy := ResizeOptions{Location: "https://a/b.png"}
+	legacy.PopulateHash()
+	if legacy.HashSum != "ff01c9083dfe331142c4352b6caf9cda5674d1dc" {
+		t.Errorf("expected the unversioned hash to stay sha1(url), got %s", legacy.HashSum)
+	}
+
+	v1 := ResizeOptions{Location: "https://a/b.png", Version: "1"}
+	v1.PopulateHash()
+	v2 := ResizeOptions{Location: "https://a/b.png", Version: "2"}
+	v2.PopulateHash()
+	if v1.HashSum == legacy.HashSum || v1.HashSum == v2.HashSum {
+		t.Errorf("expected each version to hash differently, got %s, %s and %s", legacy.HashSum, v1.HashSum, v2.HashSum)
+	}
+}
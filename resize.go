@@ -2,18 +2,19 @@ package asset_delivery
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"image"
-	"image/jpeg"
-	"image/png"
+	"image/color"
 	"io"
+	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
-	"strings"
+	"strconv"
 	"time"
 
-	"github.com/chai2010/webp"
 	"github.com/disintegration/imaging"
 )
 
@@ -25,23 +26,43 @@ const ResizeTopic = "asset-delivery-resize"
 // supplied one.
 var defaultCacheControl = os.Getenv("DEFAULT_CACHE_CONTROL")
 
-func Resize(fs FileSystem, opts ResizeOptions) error {
-	buf, cc, err := GetImage(opts.Location)
-	if err != nil {
-		return &ParamError{Param: "url", Detail: fmt.Sprintf("Could not get image: %s", opts.Location), RootError: err}
+// MaxSourceBytes caps the size of a downloaded source image. Set with
+// MAX_SOURCE_BYTES.
+var MaxSourceBytes = envInt64("MAX_SOURCE_BYTES", 50<<20)
+
+// MaxSourcePixels caps the pixel count of a source image, checked from its
+// header before it is decoded. Set with MAX_SOURCE_PIXELS.
+var MaxSourcePixels = envInt64("MAX_SOURCE_PIXELS", 50_000_000)
+
+func envInt64(key string, def int64) int64 {
+	v, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+	if err != nil || v <= 0 {
+		return def
 	}
-	img, format, err := ReaderToImage(bytes.NewReader(buf), opts.Location)
-	if err != nil {
-		return &ParamError{Param: "url", Detail: "Could not read URL as an image.", RootError: err}
+	return v
+}
+
+// Resize downloads the source with DefaultFetcher, resizes it and writes
+// the result to fs, along with the SourceInfo it was resized from when
+// opts.RecordSource is set.
+func Resize(fs FileSystem, opts ResizeOptions) error {
+	return ResizeWithFetcher(fs, DefaultFetcher, opts)
+}
+
+// ResizeWithFetcher is Resize with the source downloaded by f.
+func ResizeWithFetcher(fs FileSystem, f *Fetcher, opts ResizeOptions) error {
+	if opts.Encoding != "" && !CanEncode(opts.Encoding) {
+		return &ParamError{Param: "encoding", Detail: "Unsupported encoding.", RootError: ErrFileNotHandled}
 	}
-	img, err = ResizeImage(img, opts.Width)
+	buf, header, err := f.fetch(opts.Location)
 	if err != nil {
-		return &SystemError{Detail: "Could not resize the provided image.", RootError: err}
+		return fetchError(opts.Location, err)
 	}
-	bits, err := ImageToBytes(img, resolveEncoding(opts.DesiredEncoding(), format), 80)
+	bits, err := resizeBytes(buf, opts)
 	if err != nil {
-		return &SystemError{Detail: "An error occurred.", RootError: err}
+		return err
 	}
+	cc := header.Get("Cache-Control")
 	if cc == "" {
 		if opts.CacheControl == "" {
 			cc = defaultCacheControl
@@ -49,36 +70,293 @@ func Resize(fs FileSystem, opts ResizeOptions) error {
 			cc = opts.CacheControl
 		}
 	}
-	if err := fs.Write(opts.ObjectKey(), bits, &WriteInfo{cacheControl: cc}); err != nil {
+	key := opts.ObjectKey()
+	// Taken before the write, so that the variant is not older than a
+	// change it records.
+	now := time.Now()
+	info := &WriteInfo{cacheControl: cc, contentType: contentType(key, bits.Bytes())}
+	if err := fs.Write(key, bits, info); err != nil {
 		return &SystemError{Detail: "An error occurred.", RootError: err}
 	}
+	if opts.RecordSource {
+		// The variant is written, so it is not failed again for this; the
+		// next revalidation records the version instead.
+		if err := recordSource(fs, opts.SourceKey(), buf, header, now); err != nil {
+			log.Printf("Could not record the source version of %s: %s", key, err)
+		}
+	}
 	return nil
 }
 
-func GetImage(url string) ([]byte, string, error) {
-	client := http.Client{
-		Timeout: time.Second * 5,
+// fetchError describes a failed download of the source at location.
+// Failures a retry may fix, such as network errors and 5xx responses, are
+// SystemErrors, so that no failure marker is written and the message is
+// redelivered. The rest, such as 404s and blocked addresses, are
+// ParamErrors.
+func fetchError(location string, err error) error {
+	var tooLarge *SourceTooLargeError
+	if errors.As(err, &tooLarge) {
+		return tooLarge
+	}
+	detail := fmt.Sprintf("Could not get image: %s", location)
+	if transientFetchError(err) {
+		return &SystemError{Detail: detail, RootError: err}
+	}
+	return &ParamError{Param: "url", Detail: detail, RootError: err}
+}
+
+func transientFetchError(err error) bool {
+	var status *OriginStatusError
+	if errors.As(err, &status) {
+		return status.Transient()
+	}
+	for _, refused := range []error{ErrAddressBlocked, ErrSchemeNotAllowed, ErrHostNotPermitted, ErrTooManyRedirects} {
+		if errors.Is(err, refused) {
+			return false
+		}
+	}
+	var uerr *url.Error
+	if errors.As(err, &uerr) && uerr.Op == "parse" {
+		return false
+	}
+	// Connection, DNS and timeout errors, and bodies cut short.
+	return true
+}
+
+// contentType returns the MIME type of the codec named by key's extension,
+// falling back to sniffing data when the key has no known extension.
+func contentType(key string, data []byte) string {
+	if c, ok := CodecByExtension(filepath.Ext(key)); ok && c.MIMEType != "" {
+		return c.MIMEType
+	}
+	return http.DetectContentType(data)
+}
+
+// resizeBytes decodes the source image in buf, resizes it and encodes the
+// result. Animations keep every frame when the output format supports
+// animation and are reduced to their first frame otherwise.
+func resizeBytes(buf []byte, opts ResizeOptions) (*bytes.Buffer, error) {
+	img, anim, format, err := decodeSource(buf, opts)
+	if err != nil {
+		return nil, err
+	}
+	if anim != nil && len(anim.Frames) > 1 {
+		anim, err = ResizeAnimation(anim, opts)
+		if errors.Is(err, ErrAnimationTooLarge) {
+			return nil, animationError(err)
+		} else if err != nil {
+			return nil, &SystemError{Detail: "Could not resize the provided image.", RootError: err}
+		}
+		bits, err := AnimationToBytes(anim, resolveEncoding(opts.DesiredEncoding(), format), opts.EncodeOptions)
+		if err != nil {
+			return nil, &SystemError{Detail: "An error occurred.", RootError: err}
+		}
+		return bits, nil
+	}
+	if anim != nil {
+		img = anim.Frames[0]
+	}
+
+	meta := readMetadata(buf, format)
+	img, err = ResizeImage(Orient(img, meta.Orientation), opts)
+	if err != nil {
+		return nil, &SystemError{Detail: "Could not resize the provided image.", RootError: err}
+	}
+	encoding := resolveEncoding(opts.DesiredEncoding(), format)
+	bits, err := ImageToBytes(img, encoding, opts.EncodeOptions)
+	if err != nil {
+		return nil, &SystemError{Detail: "An error occurred.", RootError: err}
+	}
+	if opts.KeepMetadata {
+		// The pixels are upright now, so the orientation is not copied.
+		bits, err = withMetadata(bits, encoding, Metadata{Artist: meta.Artist, Copyright: meta.Copyright})
+		if err != nil {
+			return nil, &SystemError{Detail: "Could not write image metadata.", RootError: err}
+		}
+	}
+	return bits, nil
+}
+
+// withMetadata embeds meta in the encoded image when the codec for hint's
+// extension supports EXIF.
+func withMetadata(bits *bytes.Buffer, hint string, meta Metadata) (*bytes.Buffer, error) {
+	exif := meta.EXIF()
+	c, ok := CodecByExtension(filepath.Ext(hint))
+	if exif == nil || !ok || c.WriteEXIF == nil {
+		return bits, nil
+	}
+	data, err := c.WriteEXIF(bits.Bytes(), exif)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewBuffer(data), nil
+}
+
+// decodeSource decodes the source image in buf. Vector formats are
+// rasterized at the requested size and animations are returned whole;
+// anything else is a single image.
+func decodeSource(buf []byte, opts ResizeOptions) (image.Image, *Animation, string, error) {
+	if c, ok := vectorCodec(buf, opts.Location); ok {
+		img, err := c.Rasterize(bytes.NewReader(buf), int(opts.Width), int(opts.Height))
+		if err != nil {
+			return nil, nil, "", &ParamError{Param: "url", Detail: "Could not read URL as an image.", RootError: err}
+		}
+		return img, nil, c.Name, nil
+	}
+
+	if err := checkSourcePixels(buf); err != nil {
+		return nil, nil, "", err
+	}
+	if isAnimatedWebP(buf) {
+		return nil, nil, "", &ParamError{Param: "url", Detail: "Animated WebP sources are not supported.", RootError: ErrAnimatedWebP}
+	}
+	r := bytes.NewReader(buf)
+	anim, format, err := ReaderToAnimation(r)
+	if err != nil {
+		return nil, nil, "", animationError(err)
 	}
-	res, err := client.Get(url)
+	if anim != nil {
+		return nil, anim, format, nil
+	}
+	img, format, err := ReaderToImage(r, opts.Location)
 	if err != nil {
-		return nil, "", err
+		return nil, nil, "", &ParamError{Param: "url", Detail: "Could not read URL as an image.", RootError: err}
+	}
+	return img, nil, format, nil
+}
+
+// checkSourcePixels reads the dimensions from the image header and rejects
+// images over MaxSourcePixels before they are decoded. Headers that cannot
+// be read are left for the decoder to report.
+func checkSourcePixels(buf []byte) error {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(buf))
+	if err != nil {
+		return nil
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > MaxSourcePixels {
+		return &SourcePixelsError{Width: cfg.Width, Height: cfg.Height, Limit: MaxSourcePixels}
+	}
+	return nil
+}
+
+func animationError(err error) error {
+	if errors.Is(err, ErrAnimationTooLarge) {
+		return &ParamError{Param: "url", Detail: "The animation has too many frames or pixels.", RootError: err}
 	}
-	defer res.Body.Close()
-	buf, err := io.ReadAll(res.Body)
-	return buf, res.Header.Get("Cache-Control"), err
+	return &ParamError{Param: "url", Detail: "Could not read URL as an image.", RootError: err}
 }
 
-func ResizeImage(img image.Image, target uint) (image.Image, error) {
+// GetImage downloads url with DefaultFetcher.
+func GetImage(url string) ([]byte, string, error) {
+	return DefaultFetcher.Get(url)
+}
+
+// ResizeImage resizes img to the box described by opts.Width and
+// opts.Height according to opts.Fit. A missing dimension is derived from
+// the aspect ratio; when both are missing the image is returned unchanged.
+func ResizeImage(img image.Image, opts ResizeOptions) (image.Image, error) {
 	bounds := img.Bounds()
-	width := bounds.Max.X
-	height := bounds.Max.Y
-	if bounds.Max.X <= 0 {
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if srcW <= 0 || srcH <= 0 {
 		return nil, ErrInvalidBounds
 	}
-	ratio := float64(bounds.Max.Y) / float64(bounds.Max.X)
-	height = int(float64(target) * ratio)
-	width = int(target)
-	return imaging.Resize(img, width, height, imaging.Lanczos), nil
+	width, height := int(opts.Width), int(opts.Height)
+	if width == 0 && height == 0 {
+		return img, nil
+	}
+
+	if width == 0 || height == 0 {
+		width, height = scaleToFit(srcW, srcH, width, height)
+		if opts.Fit == FitInside && (width > srcW || height > srcH) {
+			return img, nil
+		}
+		return imaging.Resize(img, width, height, imaging.Lanczos), nil
+	}
+
+	switch opts.Fit {
+	case FitFill:
+		return imaging.Resize(img, width, height, imaging.Lanczos), nil
+	case FitCover:
+		var crop image.Rectangle
+		if opts.Gravity == GravitySmart && opts.Focus == nil {
+			crop = SmartCrop(img, width, height)
+		} else {
+			crop = coverRect(srcW, srcH, width, height, opts).Add(bounds.Min)
+		}
+		return imaging.Resize(imaging.Crop(img, crop), width, height, imaging.Lanczos), nil
+	case FitContain:
+		w, h := containSize(srcW, srcH, width, height)
+		resized := imaging.Resize(img, w, h, imaging.Lanczos)
+		canvas := imaging.New(width, height, color.Transparent)
+		ax, ay := opts.anchor()
+		return imaging.Paste(canvas, resized, image.Pt(int(float64(width-w)*ax), int(float64(height-h)*ay))), nil
+	case FitInside:
+		w, h := containSize(srcW, srcH, width, height)
+		if w > srcW || h > srcH {
+			return img, nil
+		}
+		return imaging.Resize(img, w, h, imaging.Lanczos), nil
+	default:
+		w, h := containSize(srcW, srcH, width, height)
+		return imaging.Resize(img, w, h, imaging.Lanczos), nil
+	}
+}
+
+// scaleToFit derives the missing dimension (passed as 0) from the source
+// aspect ratio.
+func scaleToFit(srcW, srcH, width, height int) (int, int) {
+	if width == 0 {
+		width = max(1, int(float64(height)*float64(srcW)/float64(srcH)))
+	} else {
+		height = max(1, int(float64(width)*float64(srcH)/float64(srcW)))
+	}
+	return width, height
+}
+
+// containSize returns the largest size with the source aspect ratio that
+// fits within width x height.
+func containSize(srcW, srcH, width, height int) (int, int) {
+	if float64(srcW)/float64(srcH) > float64(width)/float64(height) {
+		return scaleToFit(srcW, srcH, width, 0)
+	}
+	return scaleToFit(srcW, srcH, 0, height)
+}
+
+// coverRect returns the region of the source, relative to its origin, that
+// has the aspect ratio of width x height and is as large as possible. It is
+// centred on opts.Focus when set and otherwise positioned by opts.Gravity.
+func coverRect(srcW, srcH, width, height int, opts ResizeOptions) image.Rectangle {
+	cropW, cropH := srcW, srcH
+	if float64(srcW)/float64(srcH) > float64(width)/float64(height) {
+		cropW = max(1, int(float64(srcH)*float64(width)/float64(height)+0.5))
+	} else {
+		cropH = max(1, int(float64(srcW)*float64(height)/float64(width)+0.5))
+	}
+
+	var x, y int
+	if opts.Focus != nil {
+		x = clamp(int(opts.Focus.X*float64(srcW))-cropW/2, 0, srcW-cropW)
+		y = clamp(int(opts.Focus.Y*float64(srcH))-cropH/2, 0, srcH-cropH)
+	} else {
+		ax, ay := opts.anchor()
+		x = int(float64(srcW-cropW) * ax)
+		y = int(float64(srcH-cropH) * ay)
+	}
+	return image.Rect(x, y, x+cropW, y+cropH)
+}
+
+// anchor returns the gravity's horizontal and vertical anchors, defaulting
+// to the centre.
+func (opts *ResizeOptions) anchor() (float64, float64) {
+	a, ok := gravityAnchors[opts.Gravity]
+	if !ok {
+		a = gravityAnchors[GravityCenter]
+	}
+	return a[0], a[1]
+}
+
+func clamp(v, lo, hi int) int {
+	return max(lo, min(v, hi))
 }
 
 func DefaultImageDecode(r io.Reader) (image.Image, error) {
@@ -101,24 +379,9 @@ func DefaultImageDecode(r io.Reader) (image.Image, error) {
 // succeeds. Callers can use it to choose an output encoding when the
 // hint URL has no extension.
 func ReaderToImage(r io.ReadSeeker, hint string) (image.Image, string, error) {
-	ext := strings.ToLower(filepath.Ext(hint))
-	var fn func(io.Reader) (image.Image, error)
-	var formatHint string
-	switch ext {
-	case ".jpeg", ".jfif", ".jpg":
-		fn = jpeg.Decode
-		formatHint = "jpeg"
-	case ".png":
-		fn = png.Decode
-		formatHint = "png"
-	case ".webp":
-		fn = webp.Decode
-		formatHint = "webp"
-	}
-
-	if fn != nil {
-		if img, err := fn(r); err == nil {
-			return img, formatHint, nil
+	if c, ok := CodecByExtension(filepath.Ext(hint)); ok && c.Decode != nil {
+		if img, err := c.Decode(r); err == nil {
+			return img, c.Name, nil
 		}
 		if _, err := r.Seek(0, io.SeekStart); err != nil {
 			return nil, "", err
@@ -136,36 +399,70 @@ func ReaderToImage(r io.ReadSeeker, hint string) (image.Image, string, error) {
 	return img, format, nil
 }
 
+// ReaderToAnimation decodes r with the animation decoder of its detected
+// format. For formats without one it returns a nil Animation and leaves r
+// rewound for ReaderToImage, as it does when the format is not recognized.
+func ReaderToAnimation(r io.ReadSeeker) (*Animation, string, error) {
+	_, format, err := image.DecodeConfig(r)
+	if _, serr := r.Seek(0, io.SeekStart); serr != nil {
+		return nil, "", serr
+	}
+	if err != nil {
+		return nil, "", nil
+	}
+	c, ok := CodecByName(format)
+	if !ok || c.DecodeAnimation == nil {
+		return nil, format, nil
+	}
+	a, err := c.DecodeAnimation(r)
+	return a, format, err
+}
+
 // resolveEncoding picks the output extension for ImageToBytes. It
-// prefers the caller-supplied hint when it names a supported format
+// prefers the caller-supplied hint when it names a registered encoder
 // (covering the explicit `encoding=` query param and URLs with usable
 // extensions); otherwise it falls back to the format detected during
-// decode. Both inputs being empty/unknown returns the hint unchanged,
-// which lets ImageToBytes surface ErrFileNotHandled as before.
+// decode, or FallbackEncoding for formats that can only be read. Both
+// inputs being empty/unknown returns the hint unchanged, which lets
+// ImageToBytes surface ErrFileNotHandled as before.
 func resolveEncoding(hint, detected string) string {
-	switch strings.ToLower(hint) {
-	case ".jpeg", ".jfif", ".jpg", ".png", ".webp":
+	if c, ok := CodecByExtension(hint); ok && c.Encode != nil {
 		return hint
 	}
+	if c, ok := CodecByName(detected); ok {
+		if c.Encode == nil {
+			return FallbackEncoding
+		}
+		return c.Extension()
+	}
 	if detected != "" {
 		return "." + detected
 	}
 	return hint
 }
 
-func ImageToBytes(i image.Image, hint string, quality int) (*bytes.Buffer, error) {
-	ext := strings.ToLower(filepath.Ext(hint))
+// ImageToBytes encodes i with the codec registered for hint's extension.
+func ImageToBytes(i image.Image, hint string, opts EncodeOptions) (*bytes.Buffer, error) {
 	buf := bytes.NewBuffer([]byte{})
-	var err error
-	switch ext {
-	case ".jpeg", ".jfif", ".jpg":
-		err = jpeg.Encode(buf, i, &jpeg.Options{Quality: quality})
-	case ".png":
-		err = png.Encode(buf, i)
-	case ".webp":
-		err = webp.Encode(buf, i, &webp.Options{Quality: float32(quality)})
-	default:
-		err = ErrFileNotHandled
+	c, ok := CodecByExtension(filepath.Ext(hint))
+	if !ok || c.Encode == nil {
+		return buf, ErrFileNotHandled
 	}
+	err := c.Encode(buf, i, opts)
 	return buf, err
 }
+
+// AnimationToBytes encodes a with the codec registered for hint's
+// extension, falling back to the first frame when the codec cannot write
+// animations.
+func AnimationToBytes(a *Animation, hint string, opts EncodeOptions) (*bytes.Buffer, error) {
+	buf := bytes.NewBuffer([]byte{})
+	c, ok := CodecByExtension(filepath.Ext(hint))
+	if !ok || c.Encode == nil {
+		return buf, ErrFileNotHandled
+	}
+	if c.EncodeAnimation == nil {
+		return buf, c.Encode(buf, a.Frames[0], opts)
+	}
+	return buf, c.EncodeAnimation(buf, a, opts)
+}
@@ -3,6 +3,10 @@ package asset_delivery
 import (
 	"bytes"
 	"encoding/base64"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
 	"testing"
 )
 
@@ -65,6 +69,7 @@ func TestResolveEncoding(t *testing.T) {
 		{"jpg hint normalized through case", ".JPG", "png", ".JPG"},
 		{"empty hint falls back to detected", "", "png", ".png"},
 		{"unknown hint falls back to detected", ".tiff", "webp", ".webp"},
+		{"read-only format falls back to png", "", "tiff", ".png"},
 		{"both empty stays empty (caller surfaces ErrFileNotHandled)", "", "", ""},
 	}
 
@@ -77,3 +82,156 @@ func TestResolveEncoding(t *testing.T) {
 		})
 	}
 }
+
+func TestResizeImage(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+	cases := []struct {
+		Name   string
+		Opts   ResizeOptions
+		Width  int
+		Height int
+	}{
+		{"width only keeps aspect", ResizeOptions{Width: 100}, 100, 50},
+		{"height only keeps aspect", ResizeOptions{Height: 25}, 50, 25},
+		{"no dimensions is unchanged", ResizeOptions{}, 200, 100},
+		{"scale fits within box", ResizeOptions{Width: 100, Height: 100}, 100, 50},
+		{"scale may enlarge", ResizeOptions{Width: 400, Height: 400}, 400, 200},
+		{"cover fills box", ResizeOptions{Width: 100, Height: 100, Fit: FitCover}, 100, 100},
+		{"contain pads to box", ResizeOptions{Width: 100, Height: 100, Fit: FitContain}, 100, 100},
+		{"fill stretches to box", ResizeOptions{Width: 30, Height: 90, Fit: FitFill}, 30, 90},
+		{"inside shrinks", ResizeOptions{Width: 100, Height: 100, Fit: FitInside}, 100, 50},
+		{"inside never enlarges", ResizeOptions{Width: 400, Height: 400, Fit: FitInside}, 200, 100},
+		{"inside never enlarges width only", ResizeOptions{Width: 400, Fit: FitInside}, 200, 100},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			img, err := ResizeImage(src, c.Opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b := img.Bounds(); b.Dx() != c.Width || b.Dy() != c.Height {
+				t.Fatalf("expected %dx%d, got %dx%d", c.Width, c.Height, b.Dx(), b.Dy())
+			}
+		})
+	}
+}
+
+func TestResizeImage_ContainPadsTransparent(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+	draw.Draw(src, src.Bounds(), image.NewUniform(color.NRGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+
+	img, err := ResizeImage(src, ResizeOptions{Width: 100, Height: 100, Fit: FitContain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, a := img.At(50, 5).RGBA(); a != 0 {
+		t.Errorf("expected transparent padding, got alpha %d", a)
+	}
+	if r, _, _, a := img.At(50, 50).RGBA(); r == 0 || a == 0 {
+		t.Errorf("expected opaque red content in the middle")
+	}
+}
+
+func TestResizeImage_CoverPosition(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+	src := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+	draw.Draw(src, image.Rect(0, 0, 100, 100), image.NewUniform(red), image.Point{}, draw.Src)
+	draw.Draw(src, image.Rect(100, 0, 200, 100), image.NewUniform(blue), image.Point{}, draw.Src)
+
+	cases := []struct {
+		Name string
+		Opts ResizeOptions
+		Want color.NRGBA
+	}{
+		{"west keeps the left", ResizeOptions{Gravity: GravityWest}, red},
+		{"south-west keeps the left", ResizeOptions{Gravity: GravitySouthWest}, red},
+		{"east keeps the right", ResizeOptions{Gravity: GravityEast}, blue},
+		{"north-east keeps the right", ResizeOptions{Gravity: GravityNorthEast}, blue},
+		{"focus on the left", ResizeOptions{Focus: &FocalPoint{X: 0.1, Y: 0.5}}, red},
+		{"focus on the right", ResizeOptions{Focus: &FocalPoint{X: 0.9, Y: 0.5}}, blue},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			c.Opts.Width, c.Opts.Height, c.Opts.Fit = 50, 50, FitCover
+			img, err := ResizeImage(src, c.Opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range []image.Point{{1, 1}, {25, 25}, {48, 48}} {
+				got := color.NRGBAModel.Convert(img.At(p.X, p.Y)).(color.NRGBA)
+				if got != c.Want {
+					t.Fatalf("expected %v at %v, got %v", c.Want, p, got)
+				}
+			}
+		})
+	}
+}
+
+func TestImageToBytes_EncodeOptions(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			src.Set(x, y, color.NRGBA{R: uint8(x * 4), G: uint8(y * 4), B: uint8(x ^ y), A: 255})
+		}
+	}
+
+	t.Run("lossless webp keeps pixels", func(t *testing.T) {
+		buf, err := ImageToBytes(src, ".webp", EncodeOptions{Lossless: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, _, err := ReaderToImage(bytes.NewReader(buf.Bytes()), "a.webp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range []image.Point{{0, 0}, {13, 57}, {63, 63}} {
+			want := src.NRGBAAt(p.X, p.Y)
+			got := color.NRGBAModel.Convert(img.At(p.X, p.Y)).(color.NRGBA)
+			if got != want {
+				t.Fatalf("expected %v at %v, got %v", want, p, got)
+			}
+		}
+	})
+
+	t.Run("quality changes jpeg size", func(t *testing.T) {
+		low, err := ImageToBytes(src, ".jpg", EncodeOptions{Quality: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		high, err := ImageToBytes(src, ".jpg", EncodeOptions{Quality: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if low.Len() >= high.Len() {
+			t.Fatalf("expected quality 10 (%d bytes) to be smaller than quality 100 (%d bytes)", low.Len(), high.Len())
+		}
+	})
+
+	t.Run("progressive jpeg", func(t *testing.T) {
+		buf, err := ImageToBytes(src, ".jpg", EncodeOptions{Progressive: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(buf.Bytes(), []byte{0xff, 0xc2}) {
+			t.Fatal("expected a progressive frame header")
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("png compression level", func(t *testing.T) {
+		none, err := ImageToBytes(src, ".png", EncodeOptions{Compression: CompressionNone})
+		if err != nil {
+			t.Fatal(err)
+		}
+		best, err := ImageToBytes(src, ".png", EncodeOptions{Compression: CompressionBest})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if best.Len() >= none.Len() {
+			t.Fatalf("expected best compression (%d bytes) to be smaller than none (%d bytes)", best.Len(), none.Len())
+		}
+	})
+}
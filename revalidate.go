@@ -0,0 +1,147 @@
+package asset_delivery
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// sourceSuffix names the sidecar holding the SourceInfo of a source; see
+// ResizeOptions.SourceKey.
+const sourceSuffix = ".source"
+
+// SourceInfo identifies the version of a source its variants were resized
+// from, so that the origin can be asked whether it has changed. There is
+// one per source, shared by all of its variants.
+type SourceInfo struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	// SHA256 is the hex digest of the source, compared when the origin
+	// does not answer conditional requests.
+	SHA256 string `json:"sha256"`
+	// Checked is when the origin last confirmed this version.
+	Checked time.Time `json:"checked"`
+	// Changed is when this version replaced a different one. It is zero
+	// until the source changes.
+	Changed time.Time `json:"changed,omitempty"`
+}
+
+// Outdates reports whether a variant written at created was resized from
+// an earlier version of the source.
+func (info *SourceInfo) Outdates(created time.Time) bool {
+	return created.Before(info.Changed)
+}
+
+func newSourceInfo(body []byte, h http.Header, now time.Time) *SourceInfo {
+	sum := sha256.Sum256(body)
+	return &SourceInfo{
+		ETag:         h.Get("ETag"),
+		LastModified: h.Get("Last-Modified"),
+		SHA256:       hex.EncodeToString(sum[:]),
+		Checked:      now.UTC(),
+	}
+}
+
+// recordSource stores the version of a source just downloaded under key,
+// marking it changed at now when it differs from the one recorded.
+func recordSource(fs FileSystem, key string, body []byte, h http.Header, now time.Time) error {
+	prev, err := ReadSourceInfo(fs, key)
+	if err != nil {
+		return err
+	}
+	info := newSourceInfo(body, h, now)
+	if prev != nil {
+		info.Changed = prev.Changed
+		if prev.SHA256 != info.SHA256 {
+			info.Changed = now.UTC()
+		}
+	}
+	return WriteSourceInfo(fs, key, info)
+}
+
+// WriteSourceInfo stores info as the source sidecar key.
+func WriteSourceInfo(fs FileSystem, key string, info *SourceInfo) error {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return fs.Write(key, bytes.NewReader(b), &WriteInfo{
+		cacheControl: "no-store",
+		contentType:  "application/json",
+	})
+}
+
+// ReadSourceInfo returns the source sidecar key, or nil when none was
+// written.
+func ReadSourceInfo(fs FileSystem, key string) (*SourceInfo, error) {
+	r, err := fs.ReadCloser(key)
+	if err == ErrNoFile {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var info SourceInfo
+	if err := json.NewDecoder(r).Decode(&info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// RevalidateSource asks the origin at location whether the source whose
+// sidecar is key has changed, with a conditional request when validators
+// were stored, and reports whether it has. Either way the sidecar is
+// updated: a changed source is recorded with its Changed time, after which
+// Outdates reports the variants resized before it. A source without a
+// sidecar is taken to be current, and the origin's version recorded.
+//
+// It is used by the delivery server and may be run from a periodic job.
+func RevalidateSource(fs FileSystem, f *Fetcher, key, location string) (bool, error) {
+	info, err := ReadSourceInfo(fs, key)
+	if err != nil {
+		return false, err
+	}
+	h := http.Header{}
+	if info != nil && info.ETag != "" {
+		h.Set("If-None-Match", info.ETag)
+	}
+	if info != nil && info.LastModified != "" {
+		h.Set("If-Modified-Since", info.LastModified)
+	}
+	res, err := f.Open(location, h)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	now := time.Now()
+	changed := false
+	switch res.StatusCode {
+	case http.StatusNotModified:
+		if info == nil {
+			return false, nil
+		}
+		info.Checked = now.UTC()
+	case http.StatusOK:
+		body, err := readSource(res)
+		if err != nil {
+			return false, err
+		}
+		current := newSourceInfo(body, res.Header, now)
+		if info != nil {
+			current.Changed = info.Changed
+			if current.SHA256 != info.SHA256 {
+				current.Changed = now.UTC()
+				changed = true
+			}
+		}
+		info = current
+	default:
+		return false, &OriginStatusError{StatusCode: res.StatusCode}
+	}
+	return changed, WriteSourceInfo(fs, key, info)
+}
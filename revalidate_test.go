@@ -0,0 +1,127 @@
+package asset_delivery
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testOrigin serves body with etag, answering If-None-Match, until
+// changed.
+type testOrigin struct {
+	mu   sync.Mutex
+	body string
+	etag string
+}
+
+func (o *testOrigin) set(body, etag string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.body, o.etag = body, etag
+}
+
+func (o *testOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.etag != "" {
+		w.Header().Set("ETag", o.etag)
+		if r.Header.Get("If-None-Match") == o.etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Write([]byte(o.body))
+}
+
+func TestRevalidateSource(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Before    [2]string
+		After     [2]string
+		NoSidecar bool
+		Changed   bool
+	}{
+		{"not modified", [2]string{"a", `"1"`}, [2]string{"a", `"1"`}, false, false},
+		{"new etag", [2]string{"a", `"1"`}, [2]string{"b", `"2"`}, false, true},
+		{"same content without validators", [2]string{"a", ""}, [2]string{"a", ""}, false, false},
+		{"new content without validators", [2]string{"a", ""}, [2]string{"b", ""}, false, true},
+		{"no sidecar", [2]string{"a", `"1"`}, [2]string{"b", `"2"`}, true, false},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			origin := &testOrigin{}
+			srv := httptest.NewServer(origin)
+			defer srv.Close()
+			f := &Fetcher{AllowPrivate: true}
+			fs := &LocalFileSystem{Root: t.TempDir(), Volume: "bucket"}
+			key := "resized/abc.source"
+
+			origin.set(c.Before[0], c.Before[1])
+			checked := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+			if !c.NoSidecar {
+				body, h, err := f.fetch(srv.URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := WriteSourceInfo(fs, key, newSourceInfo(body, h, checked)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			origin.set(c.After[0], c.After[1])
+			changed, err := RevalidateSource(fs, f, key, srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != c.Changed {
+				t.Fatalf("expected changed %v, got %v", c.Changed, changed)
+			}
+			info, err := ReadSourceInfo(fs, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info == nil || !info.Checked.After(checked) || info.ETag != c.After[1] {
+				t.Fatalf("expected the sidecar to record the origin's version, got %+v", info)
+			}
+			if outdated := info.Outdates(checked); outdated != c.Changed {
+				t.Errorf("expected variants from before to be outdated %v, got %v", c.Changed, outdated)
+			}
+		})
+	}
+}
+
+func TestRecordSource(t *testing.T) {
+	fs := &LocalFileSystem{Root: t.TempDir(), Volume: "bucket"}
+	key := "resized/abc.source"
+	first := time.Now().Add(-time.Hour).UTC()
+
+	if err := recordSource(fs, key, []byte("a"), http.Header{}, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordSource(fs, key, []byte("a"), http.Header{}, first.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	info, err := ReadSourceInfo(fs, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Changed.IsZero() {
+		t.Fatalf("expected an unchanged source to have no change time, got %+v", info)
+	}
+
+	changed := first.Add(2 * time.Minute)
+	if err := recordSource(fs, key, []byte("b"), http.Header{}, changed); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordSource(fs, key, []byte("b"), http.Header{}, changed.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = ReadSourceInfo(fs, key); err != nil {
+		t.Fatal(err)
+	}
+	if !info.Changed.Equal(changed) || !info.Outdates(first) || info.Outdates(changed) {
+		t.Errorf("expected the change to be recorded at %s, got %+v", changed, info)
+	}
+}
@@ -0,0 +1,87 @@
+package asset_delivery
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSigningKeys_Verify(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	keys := SigningKeys{"old": []byte("old-secret"), "new": []byte("new-secret")}
+	signed := func(kid string, key []byte, expires time.Time) url.Values {
+		q := url.Values{"url": {"https://cdn.monstercat.com/a.png"}, "width": {"100"}}
+		SignQuery(q, kid, key, expires)
+		return q
+	}
+
+	cases := []struct {
+		Name  string
+		Query url.Values
+		Err   error
+	}{
+		{"signed", signed("new", keys["new"], time.Time{}), nil},
+		{"rotated out key still active", signed("old", keys["old"], time.Time{}), nil},
+		{"not yet expired", signed("new", keys["new"], now.Add(time.Minute)), nil},
+		{"expired", signed("new", keys["new"], now), ErrSignatureExpired},
+		{"unsigned", url.Values{"url": {"https://cdn.monstercat.com/a.png"}}, ErrSignatureMissing},
+		{"unknown key", signed("retired", []byte("retired-secret"), time.Time{}), ErrUnknownKey},
+		{"wrong secret", signed("new", keys["old"], time.Time{}), ErrSignatureInvalid},
+		{"tampered", func() url.Values {
+			q := signed("new", keys["new"], time.Time{})
+			q.Set("width", "4000")
+			return q
+		}(), ErrSignatureInvalid},
+		{"added parameter", func() url.Values {
+			q := signed("new", keys["new"], time.Time{})
+			q.Set("force", "1")
+			return q
+		}(), ErrSignatureInvalid},
+		{"extended expiry", func() url.Values {
+			q := signed("new", keys["new"], now.Add(-time.Minute))
+			q.Set(ExpiresParam, "9999999999")
+			return q
+		}(), ErrSignatureInvalid},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			if err := keys.Verify(c.Query, now); err != c.Err {
+				t.Fatalf("expected %v, got %v", c.Err, err)
+			}
+		})
+	}
+}
+
+func TestSignURL(t *testing.T) {
+	key := []byte("secret")
+	signed, err := SignURL("https://delivery.test/?width=100&url=https%3A%2F%2Fcdn.monstercat.com%2Fa.png", "k1", key, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("width") != "100" || q.Get(KeyIDParam) != "k1" {
+		t.Fatalf("expected the query to be kept, got %s", u.RawQuery)
+	}
+	if err := (SigningKeys{"k1": key}).Verify(q, time.Now()); err != nil {
+		t.Fatalf("expected a valid signature, got %v", err)
+	}
+}
+
+func TestParseSigningKeys(t *testing.T) {
+	keys, err := ParseSigningKeys(" k1:one, k2:t:wo ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || string(keys["k1"]) != "one" || string(keys["k2"]) != "t:wo" {
+		t.Fatalf("unexpected keys %q", keys)
+	}
+	for _, bad := range []string{"k1", ":secret", "k1:"} {
+		if _, err := ParseSigningKeys(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package asset_delivery
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// smartCropAnalysisSize bounds the longest side of the copy of the image
+// that SmartCrop analyzes. Detail at that scale is enough to place a crop
+// and keeps the analysis cheap for large sources.
+const smartCropAnalysisSize = 256
+
+// smartCropSaturationWeight scales the saturation term of the energy map
+// relative to edge strength. Edges dominate; saturation breaks ties between
+// equally busy regions in favour of colourful ones.
+const smartCropSaturationWeight = 0.25
+
+// SmartCrop returns the region of img, in img's coordinates, with the
+// aspect ratio of width x height that contains the most visual detail. The
+// region is as large as possible, like a FitCover crop, and is chosen by
+// summing an energy map of edge strength and saturation over every
+// candidate window.
+func SmartCrop(img image.Image, width, height int) image.Rectangle {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	crop := coverRect(srcW, srcH, width, height, ResizeOptions{})
+	if crop.Dx() == srcW && crop.Dy() == srcH {
+		return bounds
+	}
+
+	small := imaging.Fit(img, smartCropAnalysisSize, smartCropAnalysisSize, imaging.Box)
+	sw, sh := small.Bounds().Dx(), small.Bounds().Dy()
+	scale := float64(srcW) / float64(sw)
+
+	energy := energyMap(small)
+	sat := summedAreaTable(energy, sw, sh)
+
+	winW := clamp(int(math.Round(float64(crop.Dx())/scale)), 1, sw)
+	winH := clamp(int(math.Round(float64(crop.Dy())/scale)), 1, sh)
+
+	best := math.Inf(-1)
+	bestDist := math.Inf(1)
+	var bx, by int
+	for y := 0; y+winH <= sh; y++ {
+		for x := 0; x+winW <= sw; x++ {
+			score := sat.sum(x, y, x+winW, y+winH)
+			// Prefer the most central window among equal scores so
+			// featureless images crop like GravityCenter.
+			dist := math.Abs(float64(2*x+winW-sw)) + math.Abs(float64(2*y+winH-sh))
+			if score > best+1e-9 || (math.Abs(score-best) <= 1e-9 && dist < bestDist) {
+				best, bestDist = score, dist
+				bx, by = x, y
+			}
+		}
+	}
+
+	x := clamp(int(math.Round(float64(bx)*scale)), 0, srcW-crop.Dx())
+	y := clamp(int(math.Round(float64(by)*scale)), 0, srcH-crop.Dy())
+	return image.Rect(x, y, x+crop.Dx(), y+crop.Dy()).Add(bounds.Min)
+}
+
+// energyMap scores every pixel by its Sobel edge magnitude on luminance
+// plus a weighted saturation term. Both are scaled to roughly [0, 1].
+func energyMap(img *image.NRGBA) []float64 {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	lum := make([]float64, w*h)
+	energy := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := img.PixOffset(x, y)
+			r := float64(img.Pix[i]) / 255
+			g := float64(img.Pix[i+1]) / 255
+			b := float64(img.Pix[i+2]) / 255
+			a := float64(img.Pix[i+3]) / 255
+			lum[y*w+x] = (0.299*r + 0.587*g + 0.114*b) * a
+
+			hi := math.Max(r, math.Max(g, b))
+			lo := math.Min(r, math.Min(g, b))
+			if hi > 0 {
+				energy[y*w+x] = smartCropSaturationWeight * (hi - lo) / hi * a
+			}
+		}
+	}
+
+	at := func(x, y int) float64 {
+		return lum[clamp(y, 0, h-1)*w+clamp(x, 0, w-1)]
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			gx := at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1) -
+				at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1)
+			gy := at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1) -
+				at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1)
+			energy[y*w+x] += math.Sqrt(gx*gx+gy*gy) / 4
+		}
+	}
+	return energy
+}
+
+// areaTable is a summed-area table: entry (x, y) holds the sum of every
+// value above and to the left of it, exclusive.
+type areaTable struct {
+	w    int
+	sums []float64
+}
+
+func summedAreaTable(values []float64, w, h int) *areaTable {
+	t := &areaTable{w: w + 1, sums: make([]float64, (w+1)*(h+1))}
+	for y := 0; y < h; y++ {
+		row := 0.0
+		for x := 0; x < w; x++ {
+			row += values[y*w+x]
+			t.sums[(y+1)*t.w+x+1] = t.sums[y*t.w+x+1] + row
+		}
+	}
+	return t
+}
+
+// sum returns the total of the values in [x0, x1) x [y0, y1).
+func (t *areaTable) sum(x0, y0, x1, y1 int) float64 {
+	return t.sums[y1*t.w+x1] - t.sums[y0*t.w+x1] - t.sums[y1*t.w+x0] + t.sums[y0*t.w+x0]
+}
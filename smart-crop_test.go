@@ -0,0 +1,108 @@
+package asset_delivery
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// flatWithDetail returns a flat grey image of size w x h with a
+// checkerboard drawn over detail.
+func flatWithDetail(w, h int, detail image.Rectangle) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.NRGBA{R: 128, G: 128, B: 128, A: 255}), image.Point{}, draw.Src)
+	for y := detail.Min.Y; y < detail.Max.Y; y++ {
+		for x := detail.Min.X; x < detail.Max.X; x++ {
+			if (x/4+y/4)%2 == 0 {
+				img.Set(x, y, color.White)
+			} else {
+				img.Set(x, y, color.Black)
+			}
+		}
+	}
+	return img
+}
+
+func TestSmartCrop(t *testing.T) {
+	cases := []struct {
+		Name          string
+		W, H          int
+		Detail        image.Rectangle
+		Width, Height int
+		Size          image.Point
+	}{
+		{"detail on the right of a wide image", 300, 100, image.Rect(220, 20, 290, 80), 100, 100, image.Pt(100, 100)},
+		{"detail on the left of a wide image", 300, 100, image.Rect(10, 20, 80, 80), 100, 100, image.Pt(100, 100)},
+		{"detail at the top of a tall image", 100, 400, image.Rect(20, 10, 80, 70), 1, 1, image.Pt(100, 100)},
+		{"detail at the bottom of a tall image", 100, 400, image.Rect(20, 330, 80, 390), 1, 1, image.Pt(100, 100)},
+		{"detail touching the edge", 300, 100, image.Rect(250, 0, 300, 100), 1, 1, image.Pt(100, 100)},
+		{"large image is analyzed downscaled", 3000, 1000, image.Rect(2200, 200, 2900, 800), 1, 1, image.Pt(1000, 1000)},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			got := SmartCrop(flatWithDetail(c.W, c.H, c.Detail), c.Width, c.Height)
+			if got.Size() != c.Size {
+				t.Fatalf("expected a %v crop, got %v", c.Size, got)
+			}
+			if !c.Detail.In(got) {
+				t.Fatalf("expected the crop %v to contain the detail at %v", got, c.Detail)
+			}
+		})
+	}
+}
+
+func TestSmartCrop_Exact(t *testing.T) {
+	cases := []struct {
+		Name          string
+		Image         image.Image
+		Width, Height int
+		Want          image.Rectangle
+	}{
+		{"featureless image crops the centre", flatWithDetail(300, 100, image.Rectangle{}), 100, 100, image.Rect(100, 0, 200, 100)},
+		{"matching aspect ratio keeps everything", flatWithDetail(200, 100, image.Rect(0, 0, 10, 10)), 20, 10, image.Rect(0, 0, 200, 100)},
+		{"offset bounds are respected", flatWithDetail(300, 100, image.Rect(250, 0, 300, 100)).SubImage(image.Rect(100, 0, 300, 100)), 1, 1, image.Rect(200, 0, 300, 100)},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			if got := SmartCrop(c.Image, c.Width, c.Height); got != c.Want {
+				t.Fatalf("expected %v, got %v", c.Want, got)
+			}
+		})
+	}
+}
+
+func TestSmartCrop_PrefersSaturation(t *testing.T) {
+	// Two equally sized flat squares, one grey and one saturated, have
+	// the same edges; the colourful one should win.
+	img := image.NewNRGBA(image.Rect(0, 0, 300, 100))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(20, 20, 80, 80), image.NewUniform(color.NRGBA{R: 100, G: 100, B: 100, A: 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(220, 20, 280, 80), image.NewUniform(color.NRGBA{R: 200, G: 0, B: 0, A: 255}), image.Point{}, draw.Src)
+
+	got := SmartCrop(img, 100, 100)
+	if got.Min.X < 180 {
+		t.Fatalf("expected the crop to keep the saturated square, got %v", got)
+	}
+}
+
+func TestResizeImage_SmartGravity(t *testing.T) {
+	src := flatWithDetail(300, 100, image.Rect(220, 20, 290, 80))
+	img, err := ResizeImage(src, ResizeOptions{Width: 50, Height: 50, Fit: FitCover, Gravity: GravitySmart})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 50 || b.Dy() != 50 {
+		t.Fatalf("expected 50x50, got %dx%d", b.Dx(), b.Dy())
+	}
+	// The checkerboard ends up in the crop, so the output is not flat grey.
+	var distinct = map[color.NRGBA]bool{}
+	for y := 0; y < 50; y += 5 {
+		for x := 0; x < 50; x += 5 {
+			distinct[color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)] = true
+		}
+	}
+	if len(distinct) < 3 {
+		t.Fatalf("expected the detailed region in the crop, got %d distinct colours", len(distinct))
+	}
+}
@@ -0,0 +1,60 @@
+package asset_delivery
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"math"
+
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+)
+
+var ErrInvalidSVG = errors.New("svg has no size")
+
+// svgMaxRasterSize caps the longest side an SVG is rasterized at. A cover
+// crop of an extreme aspect ratio could otherwise ask for a huge canvas;
+// the area is also kept within MaxSourcePixels.
+const svgMaxRasterSize = 2 * MaxImageDimension
+
+// rasterizeSVG renders the SVG document in r so that it covers width x
+// height, keeping its aspect ratio. ResizeImage then applies the fit, so
+// output is drawn at (or just above) its final size instead of being
+// scaled up from a small bitmap. A zero dimension is derived from the
+// aspect ratio; with both zero the document's own size is used.
+func rasterizeSVG(r io.Reader, width, height int) (image.Image, error) {
+	icon, err := oksvg.ReadIconStream(r)
+	if err != nil {
+		return nil, err
+	}
+	vw, vh := icon.ViewBox.W, icon.ViewBox.H
+	if !(vw > 0 && vh > 0) {
+		return nil, ErrInvalidSVG
+	}
+
+	scale := 1.0
+	if width > 0 || height > 0 {
+		scale = math.Max(float64(width)/vw, float64(height)/vh)
+	}
+	if longest := math.Max(vw, vh) * scale; longest > svgMaxRasterSize {
+		scale *= svgMaxRasterSize / longest
+	}
+	if pixels := vw * vh * scale * scale; pixels > float64(MaxSourcePixels) {
+		scale *= math.Sqrt(float64(MaxSourcePixels) / pixels)
+	}
+	w := max(1, int(math.Round(vw*scale)))
+	h := max(1, int(math.Round(vh*scale)))
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	icon.SetTarget(0, 0, float64(w), float64(h))
+	scanner := rasterx.NewScannerGV(w, h, img, img.Bounds())
+	icon.Draw(rasterx.NewDasher(w, h, scanner), 1)
+	return img, nil
+}
+
+// isSVG reports whether data looks like an SVG document.
+func isSVG(data []byte) bool {
+	head := bytes.TrimLeft(data[:min(len(data), 1024)], "\xef\xbb\xbf \t\r\n")
+	return bytes.HasPrefix(head, []byte("<")) && bytes.Contains(head, []byte("<svg"))
+}
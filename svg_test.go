@@ -0,0 +1,74 @@
+package asset_delivery
+
+import (
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+const testSVG = `<?xml version="1.0"?>
+<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 20 10" width="20" height="10">
+  <rect x="0" y="0" width="10" height="10" fill="#ff0000"/>
+</svg>`
+
+func TestRasterizeSVG(t *testing.T) {
+	cases := []struct {
+		Name          string
+		Width, Height int
+		Size          image.Point
+	}{
+		{"document size", 0, 0, image.Pt(20, 10)},
+		{"width", 400, 0, image.Pt(400, 200)},
+		{"height", 0, 50, image.Pt(100, 50)},
+		{"covers the box", 100, 100, image.Pt(200, 100)},
+		{"capped", 0, 4096, image.Pt(svgMaxRasterSize, svgMaxRasterSize/2)},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			img, err := rasterizeSVG(strings.NewReader(testSVG), c.Width, c.Height)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s := img.Bounds().Size(); s != c.Size {
+				t.Fatalf("expected %v, got %v", c.Size, s)
+			}
+		})
+	}
+}
+
+func TestResizeBytes_SVGRendersAtWidth(t *testing.T) {
+	for _, location := range []string{"https://a/logo.svg", "https://a/logo"} {
+		t.Run(location, func(t *testing.T) {
+			opts := ResizeOptions{Width: 400, Location: location}
+			bits, err := resizeBytes([]byte(testSVG), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := png.Decode(bits)
+			if err != nil {
+				t.Fatalf("expected png output, got %v", err)
+			}
+			if s := img.Bounds().Size(); s != image.Pt(400, 200) {
+				t.Fatalf("expected 400x200, got %v", s)
+			}
+			// A bitmap scaled up 20x would blur the rectangle's edge; a
+			// rendered one stays crisp.
+			if _, _, _, a := img.At(201, 100).RGBA(); a != 0 {
+				t.Fatalf("expected a sharp edge, got %v next to it", img.At(201, 100))
+			}
+			if r, _, _, a := img.At(198, 100).RGBA(); r != 0xffff || a != 0xffff {
+				t.Fatalf("expected solid red inside the edge, got %v", img.At(198, 100))
+			}
+		})
+	}
+}
+
+func TestIsSVG(t *testing.T) {
+	if !isSVG([]byte("\n  " + testSVG)) {
+		t.Error("expected an SVG document to be recognized")
+	}
+	if isSVG([]byte("\x89PNG\r\n\x1a\n<svg")) {
+		t.Error("expected binary data not to be recognized")
+	}
+}
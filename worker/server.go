@@ -0,0 +1,173 @@
+// Package worker implements the resize worker that consumes resize
+// requests and writes resized assets to a FileSystem.
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/monstercat/golib/logger"
+
+	. "github.com/monstercat/asset-delivery"
+)
+
+// maxPushBodyBytes caps incoming Pub/Sub push bodies. Pub/Sub push
+// payloads are well under 1 MiB in practice; the limit guards against
+// malformed clients.
+const maxPushBodyBytes = 10 << 20
+
+// PubSubPushRequest is the envelope Pub/Sub delivers to a push endpoint.
+// See https://cloud.google.com/pubsub/docs/push#receive_push.
+type PubSubPushRequest struct {
+	Message struct {
+		Data        []byte            `json:"data"`
+		MessageID   string            `json:"messageId"`
+		PublishTime string            `json:"publishTime"`
+		Attributes  map[string]string `json:"attributes,omitempty"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// Server handles Pub/Sub push deliveries for the asset-delivery-resize
+// topic and runs the resize against the configured FileSystem.
+type Server struct {
+	logger.Logger
+	FS FileSystem
+	// PermittedHosts is checked against every source URL before it is
+	// fetched, as the delivery server does; resize messages are not
+	// trusted to have passed through it.
+	PermittedHosts []string
+	// Fetcher downloads sources. It defaults to a Fetcher limited to
+	// PermittedHosts, so redirects are held to the same list.
+	Fetcher *Fetcher
+	// LeaseTTL is used when FS is a Leaser, so that only one worker
+	// resizes a given key at a time. It defaults to DefaultLeaseTTL.
+	LeaseTTL time.Duration
+	// FailureTTL is how long a variant that failed with a 4xx error, such
+	// as a missing or undecodable source, is not resized again. It
+	// defaults to DefaultFailureTTL.
+	FailureTTL time.Duration
+
+	once sync.Once
+}
+
+func (s *Server) failureTTL() time.Duration {
+	if s.FailureTTL > 0 {
+		return s.FailureTTL
+	}
+	return DefaultFailureTTL
+}
+
+func (s *Server) leaseTTL() time.Duration {
+	if s.LeaseTTL > 0 {
+		return s.LeaseTTL
+	}
+	return DefaultLeaseTTL
+}
+
+func (s *Server) fetcher() *Fetcher {
+	s.once.Do(func() {
+		if s.Fetcher == nil {
+			s.Fetcher = &Fetcher{PermittedHosts: s.PermittedHosts}
+		}
+	})
+	return s.Fetcher
+}
+
+// ServeHTTP decodes the push envelope, unmarshals the embedded
+// ResizeOptions, and runs the resize. HTTP status semantics drive
+// Pub/Sub redelivery: 2xx acks the message, 4xx tells Pub/Sub the
+// payload is bad (route to dead letter), 5xx triggers a retry.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPushBodyBytes))
+	if err != nil {
+		s.Log(logger.SeverityError, "Failed to read request body: "+err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var req PubSubPushRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		s.Log(logger.SeverityError, "Failed to unmarshal push envelope: "+err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := s.HandleMessage(req.Message.MessageID, req.Message.Data); err != nil {
+		w.WriteHeader(ErrorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleMessage unmarshals the ResizeOptions carried by a resize message
+// and runs the resize. The returned error's status (see ErrorStatus)
+// follows the same rules as ServeHTTP: 4xx for bad payloads, 5xx for
+// transient failures. messageID is only used for logging.
+func (s *Server) HandleMessage(messageID string, body []byte) error {
+	var data ResizeOptions
+	if err := json.Unmarshal(body, &data); err != nil {
+		s.Log(logger.SeverityError, fmt.Sprintf("Could not unmarshal resize options (messageId=%s): %s", messageID, err))
+		return &ParamError{Param: "data", Detail: "Could not unmarshal resize options", RootError: err}
+	}
+
+	data.PopulateHash()
+
+	l := &logger.Contextual{
+		Logger:  s.Logger,
+		Context: data,
+	}
+	l.Log(logger.SeverityInfo, fmt.Sprintf("Resizing (messageId=%s, hash=%s, width=%d)", messageID, data.HashSum, data.Width))
+
+	if u, err := url.Parse(data.Location); err != nil || !HostPermitted(s.PermittedHosts, u.Host) {
+		l.Log(logger.SeverityWarning, "Invalid host: "+data.Location)
+		return &ParamError{Param: "url", Detail: "Host is not permitted to perform this action."}
+	}
+
+	if leaser, ok := s.FS.(Leaser); ok {
+		release, err := leaser.Lease(data.ObjectKey(), s.leaseTTL())
+		if err == ErrLeaseHeld {
+			// The holder writes the same object; this message is a duplicate.
+			l.Log(logger.SeverityInfo, "Another worker is resizing "+data.ObjectKey())
+			return nil
+		}
+		if err != nil {
+			l.Log(logger.SeverityError, "Could not take resize lease: "+err.Error())
+			return &SystemError{Detail: "Could not take resize lease.", RootError: err}
+		}
+		defer func() {
+			if err := release(); err != nil && err != ErrNoFile {
+				l.Log(logger.SeverityWarning, "Could not release resize lease: "+err.Error())
+			}
+		}()
+	}
+
+	if err := ResizeWithFetcher(s.FS, s.fetcher(), data); err != nil {
+		if v, ok := err.(RootError); ok && v.Root() != nil {
+			l.Log(logger.SeverityError, "Could not resize image: "+err.Error()+"; "+v.Root().Error())
+		} else {
+			l.Log(logger.SeverityError, "Could not resize image: "+err.Error())
+		}
+		if ErrorStatus(err) < http.StatusInternalServerError {
+			// Retrying will fail the same way; tell the delivery server.
+			if ferr := WriteFailure(s.FS, data.ObjectKey(), NewFailure(err, time.Now(), s.failureTTL())); ferr != nil {
+				l.Log(logger.SeverityWarning, "Could not write failure marker: "+ferr.Error())
+			}
+		}
+		return err
+	}
+	// An expired failure marker is cleared by the delivery server when it
+	// reads it, so success does not cost a delete.
+	return nil
+}
@@ -0,0 +1,419 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/monstercat/golib/logger"
+
+	. "github.com/monstercat/asset-delivery"
+	"github.com/monstercat/asset-delivery/assetdeliverytest"
+)
+
+type noopLogger struct{}
+
+func (noopLogger) Log(_ logger.Severity, _ any) {}
+
+func newTestServer() *Server {
+	return &Server{Logger: noopLogger{}}
+}
+
+func TestServeHTTP_RejectsNonPOST(t *testing.T) {
+	s := newTestServer()
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", rec.Code)
+	}
+}
+
+func TestServeHTTP_RejectsMalformedEnvelope(t *testing.T) {
+	s := newTestServer()
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("not json"))))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for malformed envelope, got %d", rec.Code)
+	}
+}
+
+func TestServeHTTP_RejectsMalformedMessageData(t *testing.T) {
+	envelope := map[string]any{
+		"message": map[string]any{
+			"data":      base64.StdEncoding.EncodeToString([]byte("not json either")),
+			"messageId": "test-msg-1",
+		},
+		"subscription": "projects/test/subscriptions/sub",
+	}
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer()
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for bad message data, got %d", rec.Code)
+	}
+}
+
+func pushBody(t *testing.T, opts ResizeOptions) []byte {
+	t.Helper()
+	data, err := json.Marshal(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(map[string]any{
+		"message": map[string]any{
+			"data":      base64.StdEncoding.EncodeToString(data),
+			"messageId": "test-msg",
+		},
+		"subscription": "projects/test/subscriptions/sub",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// newResizeServer returns a Server that may fetch from the loopback
+// origins started by newOrigin.
+func newResizeServer(fs FileSystem) *Server {
+	return &Server{Logger: noopLogger{}, FS: fs, Fetcher: &Fetcher{AllowPrivate: true}}
+}
+
+func newOrigin(t *testing.T, cacheControl string) *httptest.Server {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 32))
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cover.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", cacheControl)
+		w.Write(buf.Bytes())
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestServeHTTP_KeepsUncacheableOriginControl(t *testing.T) {
+	for _, cc := range []string{"no-store", "no-cache", "private, no-store, max-age=0"} {
+		t.Run(cc, func(t *testing.T) {
+			origin := newOrigin(t, cc)
+			fs := assetdeliverytest.NewFileSystem()
+			s := newResizeServer(fs)
+			opts := ResizeOptions{Width: 16, Location: origin.URL + "/cover.png", Encoding: "png", Prefix: "resized"}
+
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(pushBody(t, opts))))
+			if rec.Code != http.StatusNoContent {
+				t.Fatalf("expected 204, got %d", rec.Code)
+			}
+			opts.PopulateHash()
+			f, ok := fs.Get(opts.ObjectKey())
+			if !ok {
+				t.Fatalf("expected %s to be written, have %v", opts.ObjectKey(), fs.Names())
+			}
+			if f.Control != cc {
+				t.Errorf("expected the origin's %q to be kept, got %q", cc, f.Control)
+			}
+			if strings.Contains(f.Control, "s-maxage") || strings.Contains(f.Control, "public") {
+				t.Errorf("expected the variant not to be shared-cacheable, got %q", f.Control)
+			}
+		})
+	}
+}
+
+func TestServeHTTP_RecordsSource(t *testing.T) {
+	cases := []struct {
+		Name     string
+		FailOn   bool
+		Recorded bool
+	}{
+		{"recorded", false, true},
+		{"sidecar write fails", true, false},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			origin := newOrigin(t, "max-age=600")
+			fs := assetdeliverytest.NewFileSystem()
+			s := newResizeServer(fs)
+			opts := ResizeOptions{Width: 16, Location: origin.URL + "/cover.png", Encoding: "png", Prefix: "resized", RecordSource: true}
+			opts.PopulateHash()
+			if c.FailOn {
+				fs.FailOn(assetdeliverytest.OpWrite, opts.SourceKey(), errors.New("unavailable"))
+			}
+
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(pushBody(t, opts))))
+			if rec.Code != http.StatusNoContent {
+				t.Fatalf("expected 204, got %d", rec.Code)
+			}
+			if _, ok := fs.Get(opts.ObjectKey()); !ok {
+				t.Fatalf("expected %s to be written, have %v", opts.ObjectKey(), fs.Names())
+			}
+			source, err := ReadSourceInfo(fs, opts.SourceKey())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if recorded := source != nil && source.SHA256 != ""; recorded != c.Recorded {
+				t.Errorf("expected the source version recorded %v, got %+v", c.Recorded, source)
+			}
+		})
+	}
+}
+
+func TestServeHTTP_ResizesAndWrites(t *testing.T) {
+	origin := newOrigin(t, "max-age=600")
+	fs := assetdeliverytest.NewFileSystem()
+	s := newResizeServer(fs)
+
+	opts := ResizeOptions{Width: 16, Location: origin.URL + "/cover.png", Encoding: "png", Prefix: "resized"}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(pushBody(t, opts))))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+
+	opts.PopulateHash()
+	f, ok := fs.Get(opts.ObjectKey())
+	if !ok {
+		t.Fatalf("expected %s to be written, have %v", opts.ObjectKey(), fs.Names())
+	}
+	if f.Control != "max-age=600" {
+		t.Errorf("expected origin cache control to be kept, got %q", f.Control)
+	}
+	if f.Type != "image/png" {
+		t.Errorf("expected content type image/png, got %q", f.Type)
+	}
+	if source, err := ReadSourceInfo(fs, opts.SourceKey()); err != nil || source != nil {
+		t.Errorf("expected no source version unless asked for, got %+v, %v", source, err)
+	}
+	img, err := png.Decode(bytes.NewReader(f.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 16 || b.Dy() != 8 {
+		t.Errorf("expected 16x8 image, got %dx%d", b.Dx(), b.Dy())
+	}
+}
+
+func TestServeHTTP_BadOriginIs4xx(t *testing.T) {
+	origin := newOrigin(t, "")
+	fs := assetdeliverytest.NewFileSystem()
+	s := newResizeServer(fs)
+
+	opts := ResizeOptions{Width: 16, Location: origin.URL + "/missing.png", Prefix: "resized"}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(pushBody(t, opts))))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+	opts.PopulateHash()
+	if _, ok := fs.Get(opts.ObjectKey()); ok {
+		t.Fatalf("expected no resized object, have %v", fs.Names())
+	}
+	f, err := ReadFailure(fs, opts.ObjectKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f == nil || f.Status != http.StatusBadRequest || !f.Active(time.Now()) || f.Active(time.Now().Add(DefaultFailureTTL)) {
+		t.Fatalf("expected an active failure marker, got %+v", f)
+	}
+}
+
+func TestServeHTTP_SuccessLeavesFailureToDelivery(t *testing.T) {
+	origin := newOrigin(t, "")
+	fs := assetdeliverytest.NewFileSystem()
+	opts := ResizeOptions{Width: 16, Location: origin.URL + "/cover.png", Prefix: "resized"}
+	opts.PopulateHash()
+	if err := WriteFailure(fs, opts.ObjectKey(), NewFailure(errors.New("gone"), time.Now().Add(-2*time.Hour), time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	newResizeServer(fs).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(pushBody(t, opts))))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+	// The delivery server clears expired markers when it reads them, so
+	// the worker does not delete on every success.
+	if f, err := ReadFailure(fs, opts.ObjectKey()); err != nil || f == nil {
+		t.Fatalf("expected the failure marker to be left alone, got %+v, %v", f, err)
+	}
+}
+
+func TestServeHTTP_TransientFetchErrorIs5xx(t *testing.T) {
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	cases := []struct {
+		Name     string
+		Location string
+	}{
+		{"origin 503", unavailable.URL + "/cover.png"},
+		{"connection refused", closed.URL + "/cover.png"},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			fs := assetdeliverytest.NewFileSystem()
+			opts := ResizeOptions{Width: 16, Location: c.Location, Prefix: "resized"}
+			rec := httptest.NewRecorder()
+			newResizeServer(fs).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(pushBody(t, opts))))
+			if rec.Code != http.StatusInternalServerError {
+				t.Fatalf("expected 500, got %d", rec.Code)
+			}
+			opts.PopulateHash()
+			if f, err := ReadFailure(fs, opts.ObjectKey()); err != nil || f != nil {
+				t.Fatalf("expected no failure marker, got %+v, %v", f, err)
+			}
+		})
+	}
+}
+
+func TestServeHTTP_WriteErrorIs5xx(t *testing.T) {
+	origin := newOrigin(t, "")
+	fs := assetdeliverytest.NewFileSystem()
+	fs.FailOn(assetdeliverytest.OpWrite, "", errors.New("bucket unavailable"))
+	s := newResizeServer(fs)
+
+	opts := ResizeOptions{Width: 16, Location: origin.URL + "/cover.png", Prefix: "resized"}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(pushBody(t, opts))))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", rec.Code)
+	}
+}
+
+func TestServeHTTP_Leases(t *testing.T) {
+	origin := newOrigin(t, "")
+	opts := ResizeOptions{Width: 16, Location: origin.URL + "/cover.png", Prefix: "resized"}
+	opts.PopulateHash()
+	key := opts.ObjectKey()
+
+	t.Run("released after resizing", func(t *testing.T) {
+		fs := assetdeliverytest.NewFileSystem()
+		rec := httptest.NewRecorder()
+		newResizeServer(fs).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(pushBody(t, opts))))
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("expected 204, got %d", rec.Code)
+		}
+		if _, ok := fs.Get(key); !ok {
+			t.Fatalf("expected %s to be written", key)
+		}
+		if fs.Leased(key) {
+			t.Error("expected the lease to be released")
+		}
+	})
+
+	t.Run("held elsewhere", func(t *testing.T) {
+		fs := assetdeliverytest.NewFileSystem()
+		if _, err := fs.Lease(key, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		newResizeServer(fs).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(pushBody(t, opts))))
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("expected 204, got %d", rec.Code)
+		}
+		if names := fs.Names(); len(names) != 0 {
+			t.Fatalf("expected nothing written, got %v", names)
+		}
+	})
+
+	t.Run("lease error", func(t *testing.T) {
+		fs := assetdeliverytest.NewFileSystem()
+		fs.FailOn(assetdeliverytest.OpLease, "", errors.New("bucket unavailable"))
+		rec := httptest.NewRecorder()
+		newResizeServer(fs).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(pushBody(t, opts))))
+		if rec.Code != http.StatusInternalServerError {
+			t.Fatalf("expected 500, got %d", rec.Code)
+		}
+	})
+}
+
+func TestServeHTTP_SourceLimitsAre4xx(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Bytes  int64
+		Pixels int64
+		Status int
+	}{
+		{"too many bytes", 10, MaxSourcePixels, http.StatusRequestEntityTooLarge},
+		{"too many pixels", MaxSourceBytes, 64*32 - 1, http.StatusUnprocessableEntity},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			maxBytes, maxPixels := MaxSourceBytes, MaxSourcePixels
+			MaxSourceBytes, MaxSourcePixels = c.Bytes, c.Pixels
+			defer func() { MaxSourceBytes, MaxSourcePixels = maxBytes, maxPixels }()
+
+			origin := newOrigin(t, "")
+			fs := assetdeliverytest.NewFileSystem()
+			s := newResizeServer(fs)
+
+			opts := ResizeOptions{Width: 16, Location: origin.URL + "/cover.png", Prefix: "resized"}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(pushBody(t, opts))))
+			if rec.Code != c.Status {
+				t.Fatalf("expected %d, got %d", c.Status, rec.Code)
+			}
+			opts.PopulateHash()
+			if _, ok := fs.Get(opts.ObjectKey()); ok {
+				t.Fatalf("expected no resized object, have %v", fs.Names())
+			}
+		})
+	}
+}
+
+func TestServeHTTP_OriginRestrictionsAre4xx(t *testing.T) {
+	origin := newOrigin(t, "")
+	cases := []struct {
+		Name   string
+		Server func(fs FileSystem) *Server
+	}{
+		{"host not permitted", func(fs FileSystem) *Server {
+			s := newResizeServer(fs)
+			s.PermittedHosts = []string{"*.monstercat.com"}
+			return s
+		}},
+		{"loopback blocked by default", func(fs FileSystem) *Server {
+			return &Server{Logger: noopLogger{}, FS: fs}
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			fs := assetdeliverytest.NewFileSystem()
+			s := c.Server(fs)
+
+			opts := ResizeOptions{Width: 16, Location: origin.URL + "/cover.png", Prefix: "resized"}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(pushBody(t, opts))))
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("expected 400, got %d", rec.Code)
+			}
+			opts.PopulateHash()
+			if _, ok := fs.Get(opts.ObjectKey()); ok {
+				t.Fatalf("expected no resized object, have %v", fs.Names())
+			}
+		})
+	}
+}